@@ -0,0 +1,7 @@
+// Package assets embeds the static files served under /assets, css/main.css is built by tailwind before go build
+package assets
+
+import "embed"
+
+//go:embed all:css js icons logo.svg gbif-extinct-white-paper.pdf
+var FS embed.FS
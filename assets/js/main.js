@@ -13,6 +13,9 @@ function updateFields(){
     const searchParams = url.searchParams;
     console.info('updateFields', url.search);
     const filterForm = document.getElementById('filterForm');
+    if (!filterForm) {
+        return;
+    }
     const inputs = filterForm.querySelectorAll('input, select');
     inputs.forEach(input => {
         if (searchParams.has(input.name)) {
@@ -29,16 +32,35 @@ function updateFields(){
 
 /* Handle download button logic */
 const downloadButton = document.getElementById('downloadBtn');
-downloadButton.addEventListener('click', onDownloadClick);
+if (downloadButton) {
+    downloadButton.addEventListener('click', onDownloadClick);
+}
 function onDownloadClick() {
-    if (!confirm('Do you want to the search result as csv file (max. 1_000 rows)?')) {
+    const format = document.getElementById('downloadFormat')?.value || 'csv';
+    if (!confirm('Do you want to download all rows of the search result as ' + format + ' file?')) {
         return;
     }
-    const downloadUrl = "/download" + new URL(window.location.href).search;
+    const params = new URL(window.location.href).searchParams;
+    params.set('format', format);
+    const downloadUrl = "/download?" + params.toString();
     console.info('onDownloadClick', downloadUrl);
     window.open(downloadUrl, '_blank');
 }
 
+/* Open the map with the current filters */
+const mapButton = document.getElementById('mapBtn');
+if (mapButton) {
+    mapButton.addEventListener('click', onMapClick);
+}
+function onMapClick() {
+    const params = new URL(window.location.href).searchParams;
+    params.delete('page');
+    params.delete('order_by');
+    params.delete('order_dir');
+    const mapUrl = "/map?" + params.toString();
+    console.info('onMapClick', mapUrl);
+    window.location.href = mapUrl;
+}
 
 window.onload = function () {
     updateFields();
@@ -49,4 +71,47 @@ document.body.addEventListener("showMessage", function(evt){
    if(evt.detail.level === "error"){
      alert(evt.detail.message);   
    }
-})
\ No newline at end of file
+})
+
+/* Follow the progress of background fetches, see components.FetchJob */
+htmx.onLoad(function (elt) {
+    if (elt.matches('[data-fetch-events]')) {
+        followFetchJob(elt);
+    }
+    elt.querySelectorAll('[data-fetch-events]').forEach(followFetchJob);
+});
+function followFetchJob(elt) {
+    console.info('followFetchJob', elt.dataset.fetchEvents);
+    const events = new EventSource(elt.dataset.fetchEvents);
+    events.addEventListener('progress', function (evt) {
+        showFetchProgress(elt, JSON.parse(evt.data));
+    });
+    events.addEventListener('done', function (evt) {
+        events.close();
+        const job = JSON.parse(evt.data);
+        showFetchProgress(elt, job);
+        if (job.status === 'failed') {
+            elt.textContent = 'failed';
+            htmx.trigger(document.body, 'showMessage', { level: 'error', message: job.message });
+            return;
+        }
+        htmx.trigger(document.body, 'filterSubmit');
+    });
+    events.onerror = function () {
+        events.close();
+        elt.textContent = 'unknown';
+    };
+}
+function showFetchProgress(elt, job) {
+    const pages = Object.entries(job.progress.pages || {});
+    const pageCount = pages.reduce((sum, [, count]) => sum + count, 0);
+    elt.textContent = job.progress.years + ' years, ' + job.progress.countries + ' countries, ' + pageCount + ' pages';
+    elt.title = pages.map(([country, count]) => country + ': ' + count).join(', ');
+}
+
+/* Pages without the filter form, e.g. the taxon page, reload after a successful fetch */
+document.body.addEventListener("filterSubmit", function(){
+    if (!document.getElementById('filterForm')) {
+        window.location.reload();
+    }
+})
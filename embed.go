@@ -0,0 +1,8 @@
+package main
+
+import "embed"
+
+// README.md is rendered as the about page
+//
+//go:embed README.md
+var readme embed.FS
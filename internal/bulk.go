@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Number of rows per INSERT statement, DuckDB handles large parameter lists fine but we keep the statements reasonable
+const DefaultBulkBatchSize = 1_000
+
+type ConflictMode int
+
+const (
+	ConflictFail ConflictMode = iota
+	ConflictIgnore
+	ConflictReplace
+)
+
+// Execer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// BulkWriter collects rows and writes them as parameterized multi row inserts.
+// Values are never interpolated into the SQL string, which makes it safe for data coming from GBIF or import files.
+// Call Flush after the last Add to write the remaining rows.
+type BulkWriter struct {
+	db        Execer
+	insert    string
+	columns   int
+	batchSize int
+	args      []any
+	total     int
+}
+
+// NewBulkWriter creates a writer for the given table and columns
+func NewBulkWriter(db Execer, table string, columns []string, mode ConflictMode) *BulkWriter {
+	var insert string
+	switch mode {
+	case ConflictIgnore:
+		insert = "INSERT OR IGNORE INTO "
+	case ConflictReplace:
+		insert = "INSERT OR REPLACE INTO "
+	default:
+		insert = "INSERT INTO "
+	}
+	insert += table + " (" + strings.Join(columns, ", ") + ") VALUES "
+
+	return &BulkWriter{
+		db:        db,
+		insert:    insert,
+		columns:   len(columns),
+		batchSize: DefaultBulkBatchSize,
+	}
+}
+
+// WithBatchSize changes the number of rows per statement
+func (w *BulkWriter) WithBatchSize(size int) *BulkWriter {
+	if size > 0 {
+		w.batchSize = size
+	}
+	return w
+}
+
+// Add a row, the values must be in the same order as the columns. Writes a batch if it is full.
+func (w *BulkWriter) Add(ctx context.Context, values ...any) error {
+	if len(values) != w.columns {
+		return fmt.Errorf("bulk insert expected %d values, got %d", w.columns, len(values))
+	}
+	w.args = append(w.args, values...)
+	if len(w.args)/w.columns >= w.batchSize {
+		return w.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes all pending rows
+func (w *BulkWriter) Flush(ctx context.Context) error {
+	rows := len(w.args) / w.columns
+	if rows == 0 {
+		return nil
+	}
+
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", w.columns), ", ") + ")"
+	var query strings.Builder
+	query.Grow(len(w.insert) + rows*(len(placeholder)+2))
+	query.WriteString(w.insert)
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(placeholder)
+	}
+
+	_, err := w.db.ExecContext(ctx, query.String(), w.args...)
+	w.args = w.args[:0]
+	if err != nil {
+		return err
+	}
+	w.total += rows
+	return nil
+}
+
+// Total number of rows written so far
+func (w *BulkWriter) Total() int {
+	return w.total
+}
+
+// Pending number of rows not yet written
+func (w *BulkWriter) Pending() int {
+	return len(w.args) / w.columns
+}
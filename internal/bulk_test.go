@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestBulkWriter(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	Load()
+	_, err := DB.Exec("CREATE OR REPLACE TABLE bulk (ID BIGINT PRIMARY KEY, Name VARCHAR, Day DATE)")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	writer := NewBulkWriter(DB, "bulk", []string{"ID", "Name", "Day"}, ConflictIgnore).WithBatchSize(1000)
+	for i := 0; i < 2500; i++ {
+		err = writer.Add(ctx, fmt.Sprint(i), "Name "+fmt.Sprint(i), "2024-01-01")
+		if err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+	}
+	if writer.Pending() != 500 {
+		t.Errorf("got %d, wanted %d", writer.Pending(), 500)
+	}
+
+	/* Values must never be interpolated into the query */
+	injection := "O'Brien'); DROP TABLE bulk; --"
+	writer.Add(ctx, 2500, injection, "2024-01-01")
+	/* Duplicates are ignored */
+	writer.Add(ctx, 1, "Duplicate", "2024-01-01")
+	err = writer.Flush(ctx)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if writer.Total() != 2502 {
+		t.Errorf("got %d, wanted %d", writer.Total(), 2502)
+	}
+
+	var count int
+	err = DB.QueryRow("SELECT COUNT(*) FROM bulk").Scan(&count)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if count != 2501 {
+		t.Errorf("got %d, wanted %d", count, 2501)
+	}
+	var name string
+	err = DB.QueryRow("SELECT Name FROM bulk WHERE ID = 2500").Scan(&name)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if name != injection {
+		t.Errorf("got %s, wanted %s", name, injection)
+	}
+
+	err = writer.Add(ctx, 1, "Too few")
+	if err == nil {
+		t.Errorf("got %v, wanted %v", err, "error")
+	}
+
+	/* Replace overwrites existing rows */
+	writer = NewBulkWriter(DB, "bulk", []string{"ID", "Name", "Day"}, ConflictReplace)
+	writer.Add(ctx, 1, "Replaced", "2024-01-02")
+	err = writer.Flush(ctx)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	err = DB.QueryRow("SELECT Name FROM bulk WHERE ID = 1").Scan(&name)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if name != "Replaced" {
+		t.Errorf("got %s, wanted %s", name, "Replaced")
+	}
+}
+
+/* Compares the BulkWriter with the statements the import script used before */
+func BenchmarkBulkWriter(b *testing.B) {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	Load()
+	const rows = 10_000
+	columns := []string{"ObservationID", "TaxonID", "CountryCode", "ObservationDateOriginal", "ObservationDate"}
+	ctx := context.Background()
+
+	reset := func(b *testing.B) {
+		b.StopTimer()
+		_, err := DB.Exec("CREATE OR REPLACE TABLE bulk_bench (ObservationID BIGINT PRIMARY KEY, TaxonID BIGINT, CountryCode VARCHAR, ObservationDateOriginal VARCHAR, ObservationDate VARCHAR)")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+
+	b.Run("row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			for j := 0; j < rows; j++ {
+				_, err := DB.ExecContext(ctx, "INSERT OR REPLACE INTO bulk_bench ("+strings.Join(columns, ", ")+") VALUES (?, ?, ?, ?, ?)", j, j%500, "AT", "2024-01-01", "2024-01-01")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+
+	b.Run("interpolated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			var values []string
+			for j := 0; j < rows; j++ {
+				values = append(values, fmt.Sprintf("('%d', '%d', '%s', '%s', '%s')", j, j%500, "AT", "2024-01-01", "2024-01-01"))
+				if len(values) == DefaultBulkBatchSize || j == rows-1 {
+					_, err := DB.ExecContext(ctx, "INSERT OR REPLACE INTO bulk_bench ("+strings.Join(columns, ", ")+") VALUES "+strings.Join(values, ","))
+					if err != nil {
+						b.Fatal(err)
+					}
+					values = nil
+				}
+			}
+		}
+		b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			writer := NewBulkWriter(DB, "bulk_bench", columns, ConflictReplace)
+			for j := 0; j < rows; j++ {
+				if err := writer.Add(ctx, j, j%500, "AT", "2024-01-01", "2024-01-01"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := writer.Flush(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+	b.Run("appender", func(b *testing.B) {
+		conn, err := DB.Conn(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			err = conn.Raw(func(driverConn any) error {
+				appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", "bulk_bench")
+				if err != nil {
+					return err
+				}
+				for j := 0; j < rows; j++ {
+					if err := appender.AppendRow(int64(j), int64(j%500), "AT", "2024-01-01", "2024-01-01"); err != nil {
+						appender.Close()
+						return err
+					}
+				}
+				return appender.Close()
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+}
@@ -2,8 +2,11 @@ package internal
 
 import (
 	"database/sql"
+	"io/fs"
 	"log"
 	"log/slog"
+	"os"
+	"path/filepath"
 
 	_ "github.com/marcboeker/go-duckdb"
 	"github.com/spf13/viper"
@@ -21,6 +24,25 @@ type config struct {
 	TaxonSimplePath    string `mapstructure:"TAXON_SIMPLE_PATH"`
 	UserAgentPrefix    string `mapstructure:"USER_AGENT_PREFIX"`
 	CronJobIntervalSec int    `mapstructure:"CRON_JOB_INTERVAL_SEC"`
+
+	GbifApiUrl            string  `mapstructure:"GBIF_API_URL"`
+	GbifTimeoutSec        int     `mapstructure:"GBIF_TIMEOUT_SEC"`
+	GbifRetryAfterMaxSec  int     `mapstructure:"GBIF_RETRY_AFTER_MAX_SEC"`
+	GbifRequestsPerSecond float64 `mapstructure:"GBIF_REQUESTS_PER_SEC"`
+	GbifWorkers           int     `mapstructure:"GBIF_WORKERS"`
+
+	RediscoveryGapYears float64 `mapstructure:"REDISCOVERY_GAP_YEARS"`
+
+	RefreshBatchSize   int `mapstructure:"REFRESH_BATCH_SIZE"`
+	RefreshStaleMonths int `mapstructure:"REFRESH_STALE_MONTHS"`
+
+	FetchRequestsPerMin float64 `mapstructure:"FETCH_REQUESTS_PER_MIN"`
+	FetchCooldownMin    int     `mapstructure:"FETCH_COOLDOWN_MIN"`
+	FetchMaxConcurrent  int     `mapstructure:"FETCH_MAX_CONCURRENT"`
+
+	TrustedProxies string `mapstructure:"TRUSTED_PROXIES"`
+
+	DevDir string `mapstructure:"DEV_DIR"`
 }
 
 func Load() {
@@ -29,6 +51,16 @@ func Load() {
 	loadDb()
 }
 
+// Files returns the embedded files or, if DEV_DIR is set, the same directory from disk.
+// This way assets, migrations and the README can be changed during development without a rebuild.
+func Files(embedded fs.FS, dir string) fs.FS {
+	if Config == nil || Config.DevDir == "" {
+		return embedded
+	}
+	slog.Debug("Using files from disk", "path", filepath.Join(Config.DevDir, dir))
+	return os.DirFS(filepath.Join(Config.DevDir, dir))
+}
+
 // Initialize the database connection
 // DuckDB only supports one connection at a time,
 // therefore as long as the server is running we cannot connect to the database externally
@@ -62,6 +94,19 @@ func loadEnv() {
 	viper.SetDefault("USER_AGENT_PREFIX", "local")
 	viper.SetDefault("CRON_JOB_INTERVAL_SEC", 0)
 	viper.SetDefault("ROOT", ".")
+	viper.SetDefault("GBIF_API_URL", "https://api.gbif.org/v1")
+	viper.SetDefault("GBIF_TIMEOUT_SEC", 2)
+	viper.SetDefault("GBIF_RETRY_AFTER_MAX_SEC", 300)
+	viper.SetDefault("GBIF_REQUESTS_PER_SEC", 1)
+	viper.SetDefault("GBIF_WORKERS", 4)
+	viper.SetDefault("REDISCOVERY_GAP_YEARS", 50)
+	viper.SetDefault("REFRESH_BATCH_SIZE", 25)
+	viper.SetDefault("REFRESH_STALE_MONTHS", 6)
+	viper.SetDefault("FETCH_REQUESTS_PER_MIN", 6)
+	viper.SetDefault("FETCH_COOLDOWN_MIN", 60)
+	viper.SetDefault("FETCH_MAX_CONCURRENT", 2)
+	viper.SetDefault("TRUSTED_PROXIES", "")
+	viper.SetDefault("DEV_DIR", "")
 
 	viper.SetConfigName(".env")
 	viper.SetConfigType("env")
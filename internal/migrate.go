@@ -3,65 +3,224 @@ package internal
 import (
 	"context"
 	"database/sql"
-	"log"
+	"fmt"
+	"io/fs"
 	"log/slog"
-	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var migrationsDir = "./migrations"
+// Table which keeps track of the applied migration versions
+const createSchemaMigrationsQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	Version INTEGER PRIMARY KEY,
+	Name VARCHAR NOT NULL,
+	AppliedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
 
-// Helper function to run migration files. Its pretty simple and the migration will always run from the beginning.
-// The migrations must be placed in "./migrations" and have the file extension ".sql".
-func Migrations(db *sql.DB, migrationsPath string) {
-	if migrationsPath != "" {
-		migrationsDir = migrationsPath + "/migrations"
+// Migration is a single "<version>-<name>.sql" file
+type Migration struct {
+	Version int
+	Name    string
+	Query   string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt sql.NullTime
+}
+
+// Applied reports whether the migration is recorded in schema_migrations
+func (s MigrationStatus) Applied() bool {
+	return s.AppliedAt.Valid
+}
+
+// Helper function to run pending migration files, this is called on every start of the server and the scripts.
+// The migrations are embedded from "./migrations" and must have the file extension ".sql".
+func Migrations(db *sql.DB, fsys fs.FS) error {
+	applied, err := Migrate(context.Background(), db, fsys)
+	if err != nil {
+		return err
 	}
-	slog.Debug("Running migrations")
-	fs, err := os.ReadDir(migrationsDir)
+	slog.Info("Migrations ran successfully", "applied", len(applied))
+	return nil
+}
+
+// Migrate applies all migrations which are not yet recorded in schema_migrations in order of their version.
+// Each file runs in its own transaction together with its schema_migrations entry, so a failing file is not recorded
+// and the ones before it stay applied. Returns the migrations applied by this call.
+func Migrate(ctx context.Context, db *sql.DB, fsys fs.FS) ([]Migration, error) {
+	status, err := GetMigrationStatus(ctx, db, fsys)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	var queries []string
-	for _, f := range fs {
-		if f.IsDir() {
-			continue
-		}
-		if f.Name()[len(f.Name())-4:] != ".sql" {
+
+	var applied []Migration
+	for _, s := range status {
+		if s.Applied() {
 			continue
 		}
-		slog.Info("Found migration file", "file", f.Name())
-		file, err := os.ReadFile(migrationsDir + "/" + f.Name())
+		slog.Info("Applying migration", "version", s.Version, "name", s.Name)
+		err = applyMigration(ctx, db, s.Migration)
 		if err != nil {
-			log.Fatal(err)
+			return applied, fmt.Errorf("migration %03d-%s: %w", s.Version, s.Name, err)
 		}
-		queries = append(queries, string(file))
+		applied = append(applied, s.Migration)
 	}
-	ctx := context.Background()
-	conn, err := db.Conn(ctx)
+	return applied, nil
+}
+
+// GetMigrationStatus lists all migration files and when they were applied, migrations only recorded in the database
+// but missing on disk are returned as well with an empty Query
+func GetMigrationStatus(ctx context.Context, db *sql.DB, fsys fs.FS) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations(fsys)
 	if err != nil {
-		slog.Error("Failed to create migration connection", err)
-		return
+		return nil, err
 	}
-	defer conn.Close()
-	tx, err := conn.BeginTx(ctx, nil)
-	defer tx.Rollback()
+
+	_, err = db.ExecContext(ctx, createSchemaMigrationsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	applied, err := getAppliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return mergeMigrationStatus(migrations, applied), nil
+}
+
+// PendingMigrations returns the migration files which are not yet applied, used for the readiness check of the server.
+// Unlike GetMigrationStatus it only reads from the database, without schema_migrations all migrations are pending.
+func PendingMigrations(ctx context.Context, db *sql.DB, fsys fs.FS) ([]Migration, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_name = 'schema_migrations'").Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return migrations, nil
+	}
+	applied, err := getAppliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, s := range mergeMigrationStatus(migrations, applied) {
+		if !s.Applied() {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Helper to read the applied migrations by version, schema_migrations must exist
+func getAppliedMigrations(ctx context.Context, db *sql.DB) (map[int]MigrationStatus, error) {
+	rows, err := db.QueryContext(ctx, "SELECT Version, Name, AppliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var s MigrationStatus
+		err = rows.Scan(&s.Version, &s.Name, &s.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// Helper to combine the migration files with the applied migrations sorted by version
+func mergeMigrationStatus(migrations []Migration, applied map[int]MigrationStatus) []MigrationStatus {
+	var status []MigrationStatus
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, m.Version)
+		}
+		status = append(status, s)
+	}
+	for _, a := range applied {
+		status = append(status, a)
+	}
+	slices.SortFunc(status, func(a, b MigrationStatus) int {
+		return a.Version - b.Version
+	})
+	return status
+}
+
+// LoadMigrations reads the migration files sorted by version, the file name must start with a unique version number
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, ".")
 	if err != nil {
-		slog.Error("Failed to start migration transaction", err)
-		return
+		return nil, err
 	}
 
-	for _, query := range queries {
-		_, err = tx.Exec(query)
+	var migrations []Migration
+	versions := map[int]string{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".sql" {
+			continue
+		}
+		m, err := parseMigrationName(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := versions[m.Version]; ok {
+			return nil, fmt.Errorf("migration version %d used by %s and %s", m.Version, other, f.Name())
+		}
+		versions[m.Version] = f.Name()
+
+		query, err := fs.ReadFile(fsys, f.Name())
 		if err != nil {
-			slog.Error("Failed to run migration", "error", err, "query", query)
-			return
+			return nil, err
 		}
+		m.Query = string(query)
+		slog.Debug("Found migration file", "file", f.Name())
+		migrations = append(migrations, m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return a.Version - b.Version
+	})
+	return migrations, nil
+}
+
+// Helper to split "005-observation-history.sql" into version and name
+func parseMigrationName(fileName string) (Migration, error) {
+	base := strings.TrimSuffix(fileName, ".sql")
+	version, name, _ := strings.Cut(base, "-")
+	v, err := strconv.Atoi(version)
+	if err != nil || v <= 0 {
+		return Migration{}, fmt.Errorf("migration %s must start with a positive version number", fileName)
+	}
+	return Migration{Version: v, Name: name}, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m.Query)
+	if err != nil {
+		return err
 	}
-	err = tx.Commit()
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().UTC())
 	if err != nil {
-		slog.Error("Failed to commit migration", "error", err)
-		return
+		return err
 	}
-	conn.Close()
-	slog.Info("Migrations ran successfully")
+	return tx.Commit()
 }
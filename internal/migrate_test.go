@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	dir := filepath.Join(t.TempDir(), "migrations")
+	writeMigration := func(name, query string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(query), 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	writeMigration("001-demo.sql", "CREATE TABLE demo (ID INTEGER PRIMARY KEY, Name VARCHAR);")
+	writeMigration("002-demo-data.sql", "INSERT INTO demo VALUES (1, 'a'), (2, 'b');")
+	writeMigration("README.md", "not a migration")
+
+	ctx := context.Background()
+
+	/* The readiness check only reads, on a fresh database everything is pending and schema_migrations is not created */
+	pending, err := PendingMigrations(ctx, db, os.DirFS(dir))
+	if err != nil || len(pending) != 2 {
+		t.Errorf("got %v %v, wanted %v", pending, err, "001 and 002")
+	}
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'schema_migrations'").Scan(&tables)
+	if err != nil || tables != 0 {
+		t.Errorf("got %d %v, wanted %d", tables, err, 0)
+	}
+
+	applied, err := Migrate(ctx, db, os.DirFS(dir))
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(applied) != 2 {
+		t.Errorf("got %d, wanted %d", len(applied), 2)
+	}
+
+	/* Second run applies nothing, the data migration would fail on the primary key otherwise */
+	applied, err = Migrate(ctx, db, os.DirFS(dir))
+	if err != nil || len(applied) != 0 {
+		t.Errorf("got %d %v, wanted %d", len(applied), err, 0)
+	}
+
+	/* A failing file is not recorded and stops later ones, earlier ones stay applied */
+	writeMigration("003-rename.sql", "ALTER TABLE demo RENAME COLUMN Name TO Label;")
+	writeMigration("004-broken.sql", "INSERT INTO missing VALUES (1);")
+	writeMigration("005-later.sql", "CREATE TABLE later (ID INTEGER);")
+	applied, err = Migrate(ctx, db, os.DirFS(dir))
+	if err == nil {
+		t.Errorf("got %v, wanted %v", err, "error")
+	}
+	if len(applied) != 1 || applied[0].Version != 3 {
+		t.Errorf("got %v, wanted %v", applied, "003-rename")
+	}
+
+	status, err := GetMigrationStatus(ctx, db, os.DirFS(dir))
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(status) != 5 {
+		t.Fatalf("got %d, wanted %d", len(status), 5)
+	}
+	for i, want := range []bool{true, true, true, false, false} {
+		if status[i].Applied() != want {
+			t.Errorf("got %v, wanted %v for %03d", status[i].Applied(), want, status[i].Version)
+		}
+	}
+
+	pending, err = PendingMigrations(ctx, db, os.DirFS(dir))
+	if err != nil || len(pending) != 2 || pending[0].Version != 4 {
+		t.Errorf("got %v %v, wanted %v", pending, err, "004 and 005")
+	}
+
+	/* Fixing the file applies the rest */
+	writeMigration("004-broken.sql", "CREATE TABLE missing (ID INTEGER);")
+	applied, err = Migrate(ctx, db, os.DirFS(dir))
+	if err != nil || len(applied) != 2 {
+		t.Errorf("got %d %v, wanted %d", len(applied), err, 2)
+	}
+	if pending, _ = PendingMigrations(ctx, db, os.DirFS(dir)); len(pending) != 0 {
+		t.Errorf("got %v, wanted %v", pending, "none")
+	}
+	var label string
+	err = db.QueryRow("SELECT Label FROM demo WHERE ID = 2").Scan(&label)
+	if err != nil || label != "b" {
+		t.Errorf("got %s %v, wanted %s", label, err, "b")
+	}
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "migrations")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "001-a.sql"), []byte("SELECT 1;"), 0o644)
+	os.WriteFile(filepath.Join(dir, "001-b.sql"), []byte("SELECT 1;"), 0o644)
+	_, err := LoadMigrations(os.DirFS(dir))
+	if err == nil {
+		t.Errorf("got %v, wanted %v", err, "duplicate version error")
+	}
+
+	os.Remove(filepath.Join(dir, "001-b.sql"))
+	os.WriteFile(filepath.Join(dir, "init.sql"), []byte("SELECT 1;"), 0o644)
+	_, err = LoadMigrations(os.DirFS(dir))
+	if err == nil {
+		t.Errorf("got %v, wanted %v", err, "version error")
+	}
+}
@@ -0,0 +1,12 @@
+/* Append-only history of the latest observation per taxon and country, a row is added whenever a fetch or import changes it */
+CREATE SEQUENCE IF NOT EXISTS observation_history_id;
+CREATE TABLE IF NOT EXISTS observation_history (
+	HistoryID BIGINT PRIMARY KEY DEFAULT nextval('observation_history_id'),
+	TaxonID BIGINT NOT NULL,
+	CountryCode VARCHAR NOT NULL,
+	PreviousObservationID BIGINT,
+	PreviousObservationDate DATE,
+	ObservationID BIGINT,
+	ObservationDate DATE,
+	FetchedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
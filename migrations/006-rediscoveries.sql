@@ -0,0 +1,12 @@
+/* Latest observation changes where the date moved forward by more than the configured gap, one row per observation_history entry */
+CREATE TABLE IF NOT EXISTS rediscoveries (
+	HistoryID BIGINT PRIMARY KEY,
+	TaxonID BIGINT NOT NULL,
+	CountryCode VARCHAR NOT NULL,
+	PreviousObservationID BIGINT NOT NULL,
+	PreviousObservationDate DATE NOT NULL,
+	ObservationID BIGINT NOT NULL,
+	ObservationDate DATE NOT NULL,
+	GapYears DOUBLE NOT NULL,
+	DetectedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,10 @@
+/* Persistent queue of accepted taxa to refresh from GBIF, the cron job drains it by descending priority.
+   Demand is counted on taxon page views, Attempts and LastAttempt back off taxa which failed to fetch */
+CREATE TABLE IF NOT EXISTS refresh_queue (
+	TaxonID BIGINT PRIMARY KEY,
+	Priority DOUBLE NOT NULL DEFAULT 0,
+	Demand INTEGER NOT NULL DEFAULT 0,
+	Attempts INTEGER NOT NULL DEFAULT 0,
+	LastAttempt TIMESTAMP DEFAULT NULL,
+	EnqueuedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,27 @@
+/* One row per cron batch, manual fetch or CLI run, the counts are written when the run finishes */
+CREATE SEQUENCE IF NOT EXISTS fetch_run_id;
+CREATE TABLE IF NOT EXISTS fetch_runs (
+	RunID BIGINT PRIMARY KEY DEFAULT nextval('fetch_run_id'),
+	TriggeredBy VARCHAR NOT NULL,
+	StartedAt TIMESTAMP NOT NULL,
+	FinishedAt TIMESTAMP DEFAULT NULL,
+	Attempted INTEGER NOT NULL DEFAULT 0,
+	Succeeded INTEGER NOT NULL DEFAULT 0,
+	NotFound INTEGER NOT NULL DEFAULT 0,
+	Failed INTEGER NOT NULL DEFAULT 0,
+	Error VARCHAR DEFAULT NULL
+);
+/* One row per taxon of a run, ErrorType is NULL on success */
+CREATE SEQUENCE IF NOT EXISTS fetch_attempt_id;
+CREATE TABLE IF NOT EXISTS fetch_attempts (
+	AttemptID BIGINT PRIMARY KEY DEFAULT nextval('fetch_attempt_id'),
+	RunID BIGINT NOT NULL,
+	TaxonID BIGINT NOT NULL,
+	StartedAt TIMESTAMP NOT NULL,
+	DurationMs BIGINT NOT NULL,
+	Requests INTEGER NOT NULL,
+	Countries INTEGER NOT NULL,
+	ErrorType VARCHAR DEFAULT NULL,
+	StatusCode INTEGER DEFAULT NULL,
+	Error VARCHAR DEFAULT NULL
+);
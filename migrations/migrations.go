@@ -0,0 +1,7 @@
+// Package migrations embeds the SQL migration files, see internal.Migrations
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,337 @@
+// Purpose: Versioned JSON API under /api/v1, the routes table is also the source for the generated OpenAPI document
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+	"github.com/labstack/echo/v4"
+)
+
+const Prefix = "/api/v1"
+
+// Taxonomy of a taxon, empty ranks are null
+type Taxonomy struct {
+	Kingdom *string `json:"kingdom"`
+	Phylum  *string `json:"phylum"`
+	Class   *string `json:"class"`
+	Order   *string `json:"order"`
+	Family  *string `json:"family"`
+}
+
+// Observation is the latest observation of a taxon in one country, taxa without observations have null observation fields
+type Observation struct {
+	TaxonID               string   `json:"taxonID" doc:"GBIF taxon key"`
+	ScientificName        *string  `json:"scientificName"`
+	CountryCode           *string  `json:"countryCode" doc:"ISO 3166-1 alpha-2 country code"`
+	CountryName           *string  `json:"countryName"`
+	ObservationID         *string  `json:"observationID" doc:"GBIF occurrence key"`
+	ObservationDate       *string  `json:"observationDate" doc:"Date of the latest observation, YYYY-MM-DD"`
+	ObservationURL        *string  `json:"observationURL"`
+	YearsSinceObservation *float64 `json:"yearsSinceObservation"`
+	LastFetch             *string  `json:"lastFetch" doc:"Last time the taxon was fetched from GBIF, RFC 3339"`
+	IsSynonym             bool     `json:"isSynonym"`
+	SynonymID             *string  `json:"synonymID" doc:"Accepted taxon key if the taxon is a synonym"`
+	SynonymName           *string  `json:"synonymName"`
+	Taxonomy              Taxonomy `json:"taxonomy"`
+}
+
+// Taxon from the GBIF backbone
+type Taxon struct {
+	TaxonID        string   `json:"taxonID" doc:"GBIF taxon key"`
+	ScientificName string   `json:"scientificName"`
+	TaxonURL       string   `json:"taxonURL"`
+	Genus          *string  `json:"genus"`
+	LastFetch      *string  `json:"lastFetch" doc:"Last time the taxon was fetched from GBIF, RFC 3339"`
+	IsSynonym      bool     `json:"isSynonym"`
+	SynonymID      *string  `json:"synonymID" doc:"Accepted taxon key if the taxon is a synonym"`
+	SynonymName    *string  `json:"synonymName"`
+	Taxonomy       Taxonomy `json:"taxonomy"`
+}
+
+// TaxonDetail is a taxon with the latest observation per country
+type TaxonDetail struct {
+	Taxon
+	Observations []Observation `json:"observations"`
+}
+
+type Pagination struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"pageSize"`
+	TotalItems int `json:"totalItems"`
+	TotalPages int `json:"totalPages"`
+}
+
+type ObservationList struct {
+	Data       []Observation `json:"data"`
+	Pagination Pagination    `json:"pagination"`
+}
+
+type TaxonList struct {
+	Data       []Taxon    `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type Counts struct {
+	TaxaCount        int `json:"taxaCount"`
+	ObservationCount int `json:"observationCount"`
+}
+
+// Error body of all failed /api/v1 requests
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code" doc:"Machine readable error code, e.g. invalid_parameter or not_found"`
+	Message string `json:"message"`
+}
+
+type route struct {
+	method   string
+	path     string
+	summary  string
+	params   []param
+	response any
+	errors   []int
+	handler  echo.HandlerFunc
+}
+
+var routes = []route{
+	{http.MethodGet, "/observations", "Latest observation per taxon and country", listParams, ObservationList{}, []int{http.StatusBadRequest}, listObservations},
+	{http.MethodGet, "/taxa", "Taxa of the GBIF backbone, the country and observation date filters are not supported", taxaParams, TaxonList{}, []int{http.StatusBadRequest}, listTaxa},
+	{http.MethodGet, "/taxa/:id", "Single taxon with its latest observation per country", []param{idParam}, TaxonDetail{}, []int{http.StatusBadRequest, http.StatusNotFound}, getTaxon},
+	{http.MethodGet, "/counts", "Number of taxa and observations matching the filters", listParams, Counts{}, []int{http.StatusBadRequest}, getCounts},
+	{http.MethodGet, "/export", "All observations matching the filters without paging as file", exportParams, nil, []int{http.StatusBadRequest}, export},
+	{http.MethodGet, "/fetch-runs", "Cron, manual and CLI fetch runs, newest first", []param{pageParam}, FetchRunList{}, []int{http.StatusBadRequest}, listFetchRuns},
+	{http.MethodGet, "/fetch-runs/:id", "Single fetch run with the attempt of each taxon", []param{runIDParam}, FetchRunDetail{}, []int{http.StatusBadRequest, http.StatusNotFound}, getFetchRun},
+	{http.MethodGet, "/fetch-progress", "Progress of the backbone refresh and recent GBIF failures", nil, RefreshProgress{}, nil, getRefreshProgress},
+}
+
+// Register adds the API routes and the OpenAPI document to the echo instance
+func Register(e *echo.Echo) {
+	g := e.Group(Prefix)
+	for _, r := range routes {
+		g.Add(r.method, r.path, r.handler)
+	}
+	g.GET("/openapi.json", openAPI)
+}
+
+// ErrorHandler writes errors of /api/v1 requests as Error body, other requests are passed to next
+func ErrorHandler(next echo.HTTPErrorHandler) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed || !strings.HasPrefix(c.Request().URL.Path, Prefix+"/") {
+			next(err, c)
+			return
+		}
+		status := http.StatusInternalServerError
+		message := http.StatusText(status)
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			status = he.Code
+			if m, ok := he.Message.(string); ok {
+				message = m
+			} else {
+				message = http.StatusText(status)
+			}
+		}
+		c.JSON(status, Error{Status: status, Code: errorCode(status), Message: message})
+	}
+}
+
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_parameter"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	default:
+		return "internal_error"
+	}
+}
+
+func listObservations(c echo.Context) error {
+	q, err := parseQuery(c, listParams)
+	if err != nil {
+		return err
+	}
+	table := q.GetTableData(internal.DB)
+	result := ObservationList{
+		Data:       make([]Observation, 0, len(table.Rows)),
+		Pagination: pagination(q, q.GetTableCount(internal.DB)),
+	}
+	for _, row := range table.Rows {
+		result.Data = append(result.Data, NewObservation(row))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func listTaxa(c echo.Context) error {
+	q, err := parseQuery(c, taxaParams)
+	if err != nil {
+		return err
+	}
+	taxa := q.GetTaxa(internal.DB)
+	result := TaxonList{
+		Data:       make([]Taxon, 0, len(taxa)),
+		Pagination: pagination(q, q.GetTaxaCount(internal.DB)),
+	}
+	for _, row := range taxa {
+		result.Data = append(result.Data, NewTaxon(row))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getTaxon(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be a numeric GBIF taxon key")
+	}
+	taxon, err := queries.GetTaxon(internal.DB, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "taxon "+id+" not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	rows := queries.GetTaxonObservations(internal.DB, id)
+	result := TaxonDetail{Taxon: NewTaxon(taxon), Observations: make([]Observation, 0, len(rows.Rows))}
+	for _, row := range rows.Rows {
+		result.Observations = append(result.Observations, NewObservation(row))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getCounts(c echo.Context) error {
+	q, err := parseQuery(c, listParams)
+	if err != nil {
+		return err
+	}
+	counts := q.GetCounts(internal.DB)
+	return c.JSON(http.StatusOK, Counts{TaxaCount: counts.TaxaCount, ObservationCount: counts.ObservationCount})
+}
+
+// Streams the export file, the response is only committed once the first bytes are written
+func export(c echo.Context) error {
+	q, err := parseQuery(c, exportParams)
+	if err != nil {
+		return err
+	}
+	columns, err := queries.ParseExportColumns(c.QueryParam("columns"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "columns: "+err.Error())
+	}
+	format, contentType, err := queries.ParseExportFormat(c.QueryParam("format"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "observations."+format))
+	count, err := q.Export(c.Request().Context(), internal.DB, c.Response(), columns, format)
+	if err != nil && !c.Response().Committed {
+		header.Del(echo.HeaderContentType)
+		header.Del(echo.HeaderContentDisposition)
+		return err
+	}
+	if err != nil {
+		slog.Error("Failed to export observations", "format", format, "rows", count, "error", err)
+	}
+	return nil
+}
+
+// NewObservation converts a table row into its JSON representation
+func NewObservation(row queries.TableRow) Observation {
+	o := Observation{
+		TaxonID:        row.TaxonID,
+		ScientificName: nullString(row.ScientificName),
+		CountryCode:    nullString(row.CountryCode),
+		CountryName:    emptyNull(row.CountryName),
+		ObservationID:  nullString(row.ObservationID),
+		LastFetch:      nullTime(row.LastFetch, time.RFC3339),
+		IsSynonym:      row.IsSynonym,
+		SynonymID:      nullString(row.SynonymID),
+		SynonymName:    nullString(row.SynonymName),
+		Taxonomy:       newTaxonomy(row.TaxonKingdom, row.TaxonPhylum, row.TaxonClass, row.TaxonOrder, row.TaxonFamily),
+	}
+	if row.ObservationDate.Valid {
+		o.ObservationDate = nullTime(row.ObservationDate, "2006-01-02")
+		years := queries.YearsSinceObservation(row.ObservationDate.Time)
+		o.YearsSinceObservation = &years
+	}
+	if row.ObservationID.Valid {
+		url := gbif.OccurrenceURL + row.ObservationID.String
+		o.ObservationURL = &url
+	}
+	return o
+}
+
+// NewTaxon converts a taxon row into its JSON representation
+func NewTaxon(row queries.TaxonRow) Taxon {
+	return Taxon{
+		TaxonID:        row.TaxonID,
+		ScientificName: row.ScientificName,
+		TaxonURL:       gbif.SpeciesURL + row.TaxonID,
+		Genus:          emptyNull(row.TaxonGenus),
+		LastFetch:      nullTime(row.LastFetch, time.RFC3339),
+		IsSynonym:      row.IsSynonym,
+		SynonymID:      nullString(row.SynonymID),
+		SynonymName:    nullString(row.SynonymName),
+		Taxonomy:       newTaxonomy(row.TaxonKingdom, row.TaxonPhylum, row.TaxonClass, row.TaxonOrder, row.TaxonFamily),
+	}
+}
+
+func newTaxonomy(kingdom, phylum, class, order, family string) Taxonomy {
+	return Taxonomy{
+		Kingdom: emptyNull(kingdom),
+		Phylum:  emptyNull(phylum),
+		Class:   emptyNull(class),
+		Order:   emptyNull(order),
+		Family:  emptyNull(family),
+	}
+}
+
+func pagination(q queries.Query, total int) Pagination {
+	page, _ := strconv.Atoi(q.PAGE)
+	size := int(queries.DefaultPageLimit)
+	return Pagination{
+		Page:       max(page, 1),
+		PageSize:   size,
+		TotalItems: total,
+		TotalPages: (total + size - 1) / size,
+	}
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullTime(t sql.NullTime, layout string) *string {
+	if !t.Valid {
+		return nil
+	}
+	s := t.Time.UTC().Format(layout)
+	return &s
+}
+
+func emptyNull(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
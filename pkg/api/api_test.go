@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
+	"github.com/labstack/echo/v4"
+)
+
+// Demo data for testing, it is no synonym
+var DemoTaxa = []string{
+	"4492208", "4492208", "'Urocerus gigas'", "'Animalia'", "'Arthropoda'", "'Insecta'", "'Hymenoptera'", "'Siricidae'", "'Urocerus'",
+}
+
+var DemoObservation = []string{DemoTaxa[0], "123456", "'1989-01-05'", "'1989-01-05'", "'AT'"}
+
+// Demo data for testing which is a synonym
+var DemoSyn = []string{
+	"8071112", "4492208", "'Urocerus gigas'", "'Ichneumon gigas'", "'Animalia'", "'Arthropoda'", "'Insecta'", "'Hymenoptera'", "'Siricidae'", "'Urocerus'", "true",
+}
+
+func TestListObservations(t *testing.T) {
+	loadDemo()
+	rec := request("/api/v1/observations?show_synonyms=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, wanted %d", rec.Code, http.StatusOK)
+	}
+	var list ObservationList
+	decode(rec, &list)
+	if len(list.Data) != 2 {
+		t.Fatalf("got %d, wanted %d", len(list.Data), 2)
+	}
+	if list.Pagination.TotalItems != 2 || list.Pagination.TotalPages != 1 || list.Pagination.Page != 1 {
+		t.Errorf("got %+v, wanted %s", list.Pagination, "2 items on 1 page")
+	}
+	obs := list.Data[0]
+	if obs.ObservationDate == nil || *obs.ObservationDate != "1989-01-05" {
+		t.Errorf("got %v, wanted %s", obs.ObservationDate, "1989-01-05")
+	}
+	if obs.CountryName == nil || *obs.CountryName != "Austria" {
+		t.Errorf("got %v, wanted %s", obs.CountryName, "Austria")
+	}
+	if obs.ObservationURL == nil || *obs.ObservationURL != "https://www.gbif.org/occurrence/123456" {
+		t.Errorf("got %v, wanted %s", obs.ObservationURL, "https://www.gbif.org/occurrence/123456")
+	}
+	/* No sql.Null* structs in the output */
+	if strings.Contains(rec.Body.String(), `"Valid"`) {
+		t.Errorf("got %s, wanted %s", rec.Body.String(), "no Valid fields")
+	}
+}
+
+func TestListTaxa(t *testing.T) {
+	loadDemo()
+	rec := request("/api/v1/taxa?search=gigas")
+	var list TaxonList
+	decode(rec, &list)
+	if len(list.Data) != 1 || list.Data[0].TaxonID != DemoTaxa[0] {
+		t.Fatalf("got %+v, wanted %s", list.Data, DemoTaxa[0])
+	}
+	if list.Data[0].Taxonomy.Family == nil || *list.Data[0].Taxonomy.Family != "Siricidae" {
+		t.Errorf("got %v, wanted %s", list.Data[0].Taxonomy.Family, "Siricidae")
+	}
+	if list.Data[0].LastFetch != nil {
+		t.Errorf("got %v, wanted %v", *list.Data[0].LastFetch, nil)
+	}
+}
+
+func TestGetTaxon(t *testing.T) {
+	loadDemo()
+	rec := request("/api/v1/taxa/" + DemoSyn[0])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, wanted %d", rec.Code, http.StatusOK)
+	}
+	var detail TaxonDetail
+	decode(rec, &detail)
+	if !detail.IsSynonym || detail.SynonymID == nil || *detail.SynonymID != DemoTaxa[0] {
+		t.Errorf("got %+v, wanted synonym of %s", detail.Taxon, DemoTaxa[0])
+	}
+	if len(detail.Observations) != 1 {
+		t.Errorf("got %d, wanted %d", len(detail.Observations), 1)
+	}
+
+	rec = request("/api/v1/taxa/1")
+	var apiErr Error
+	decode(rec, &apiErr)
+	if rec.Code != http.StatusNotFound || apiErr.Code != "not_found" {
+		t.Errorf("got %d %s, wanted %d %s", rec.Code, apiErr.Code, http.StatusNotFound, "not_found")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	loadDemo()
+	for _, url := range []string{"/api/v1/observations?page=0", "/api/v1/taxa?order_by=color", "/api/v1/counts?show_synonyms=maybe", "/api/v1/taxa/abc", "/api/v1/observations?observed_before=19", "/api/v1/counts?min_years=-1", "/api/v1/observations?country=AT,XX", "/api/v1/counts?region=atlantis", "/api/v1/taxa?country=AT", "/api/v1/taxa?min_years=10", "/api/v1/taxa?order_by=date", "/api/v1/export?page=2"} {
+		rec := request(url)
+		var apiErr Error
+		decode(rec, &apiErr)
+		if rec.Code != http.StatusBadRequest || apiErr.Status != http.StatusBadRequest || apiErr.Code != "invalid_parameter" || apiErr.Message == "" {
+			t.Errorf("got %d %+v, wanted %d for %s", rec.Code, apiErr, http.StatusBadRequest, url)
+		}
+	}
+
+	rec := request("/api/v1/unknown")
+	var apiErr Error
+	decode(rec, &apiErr)
+	if rec.Code != http.StatusNotFound || apiErr.Code != "not_found" {
+		t.Errorf("got %d %+v, wanted %d", rec.Code, apiErr, http.StatusNotFound)
+	}
+}
+
+func TestGetCounts(t *testing.T) {
+	loadDemo()
+	var counts Counts
+	decode(request("/api/v1/counts?country=at"), &counts)
+	if counts.ObservationCount != 1 {
+		t.Errorf("got %d, wanted %d", counts.ObservationCount, 1)
+	}
+
+	decode(request("/api/v1/counts?region=europe&exclude_country=at"), &counts)
+	if counts.ObservationCount != 0 {
+		t.Errorf("got %d, wanted %d", counts.ObservationCount, 0)
+	}
+}
+
+func TestExport(t *testing.T) {
+	loadDemo()
+	rec := request("/api/v1/export?format=ndjson&columns=TaxonID,CountryName&show_synonyms=true")
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "application/x-ndjson" {
+		t.Fatalf("got %d %s, wanted %d", rec.Code, rec.Header().Get(echo.HeaderContentType), http.StatusOK)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 || !slices.Contains(lines, `{"TaxonID":4492208,"CountryName":"Austria"}`) {
+		t.Errorf("got %v, wanted %s", lines, `{"TaxonID":4492208,"CountryName":"Austria"}`)
+	}
+
+	for _, url := range []string{"/api/v1/export?format=xml", "/api/v1/export?columns=Color"} {
+		rec = request(url)
+		var apiErr Error
+		decode(rec, &apiErr)
+		if rec.Code != http.StatusBadRequest || apiErr.Code != "invalid_parameter" {
+			t.Errorf("got %d %+v, wanted %d for %s", rec.Code, apiErr, http.StatusBadRequest, url)
+		}
+	}
+}
+
+func TestFetchRuns(t *testing.T) {
+	loadDemo()
+	_, err := internal.DB.Exec(`INSERT INTO fetch_runs (TriggeredBy, StartedAt, FinishedAt, Attempted, Failed) VALUES ('cron', '2024-05-01 10:00:00', '2024-05-01 10:01:00', 1, 1)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = internal.DB.Exec(`INSERT INTO fetch_attempts (RunID, TaxonID, StartedAt, DurationMs, Requests, Countries, ErrorType, StatusCode, Error)
+		VALUES (1, ` + DemoTaxa[0] + `, '2024-05-01 10:00:00', 1200, 3, 0, 'upstream', 503, 'gbif: upstream error')`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var list FetchRunList
+	decode(request("/api/v1/fetch-runs"), &list)
+	if len(list.Data) != 1 || list.Pagination.TotalItems != 1 {
+		t.Fatalf("got %+v, wanted %d run", list, 1)
+	}
+	if run := list.Data[0]; run.TriggeredBy != "cron" || run.StartedAt != "2024-05-01T10:00:00Z" || run.FinishedAt == nil || run.Failed != 1 {
+		t.Errorf("got %+v, wanted the finished cron run", run)
+	}
+
+	rec := request("/api/v1/fetch-runs/1")
+	var detail FetchRunDetail
+	decode(rec, &detail)
+	if rec.Code != http.StatusOK || len(detail.Attempts) != 1 {
+		t.Fatalf("got %d %+v, wanted %d attempt", rec.Code, detail, 1)
+	}
+	attempt := detail.Attempts[0]
+	if attempt.ErrorType == nil || *attempt.ErrorType != "upstream" || attempt.StatusCode == nil || *attempt.StatusCode != 503 {
+		t.Errorf("got %+v, wanted %s with status %d", attempt, "upstream", 503)
+	}
+	if attempt.ScientificName == nil || *attempt.ScientificName != "Urocerus gigas" {
+		t.Errorf("got %v, wanted %s", attempt.ScientificName, "Urocerus gigas")
+	}
+
+	for url, status := range map[string]int{"/api/v1/fetch-runs/2": http.StatusNotFound, "/api/v1/fetch-runs/abc": http.StatusBadRequest, "/api/v1/fetch-runs?page=0": http.StatusBadRequest} {
+		if rec := request(url); rec.Code != status {
+			t.Errorf("got %d, wanted %d for %s", rec.Code, status, url)
+		}
+	}
+}
+
+func TestRefreshProgress(t *testing.T) {
+	loadDemo()
+	_, err := internal.DB.Exec("UPDATE taxa SET LastFetch = now()::TIMESTAMP WHERE TaxonID = ?", DemoTaxa[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	var progress RefreshProgress
+	decode(request("/api/v1/fetch-progress"), &progress)
+	if progress.TotalTaxa != 1 || progress.FetchedTaxa != 1 || progress.DueTaxa != 0 || progress.Percent != 100 {
+		t.Errorf("got %+v, wanted %s", progress, "one fetched taxon")
+	}
+	if progress.Errors == nil {
+		t.Errorf("got %v, wanted %s", progress.Errors, "empty list")
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	rec := request("/api/v1/openapi.json")
+	var doc struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	decode(rec, &doc)
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("got %s, wanted %s", doc.OpenAPI, "3.0.3")
+	}
+	for _, r := range routes {
+		if _, ok := doc.Paths[openAPIPath(r.path)]["get"]; !ok {
+			t.Errorf("got %v, wanted %s", doc.Paths, r.path)
+		}
+	}
+	for _, name := range []string{"Observation", "Taxon", "TaxonDetail", "Pagination", "Error"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("got %v, wanted %s", doc.Components.Schemas, name)
+		}
+	}
+}
+
+// Helper to run a request against a new echo instance with the api routes
+func request(url string) *httptest.ResponseRecorder {
+	e := echo.New()
+	Register(e)
+	e.HTTPErrorHandler = ErrorHandler(e.DefaultHTTPErrorHandler)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	return rec
+}
+
+func decode(rec *httptest.ResponseRecorder, v any) {
+	err := json.Unmarshal(rec.Body.Bytes(), v)
+	if err != nil {
+		log.Fatalf("invalid json %s: %v", rec.Body.String(), err)
+	}
+}
+
+// Helper to setup memory database and data
+func loadDemo() {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	internal.Load()
+	if err := internal.Migrations(internal.DB, migrations.FS); err != nil {
+		log.Fatal(err)
+	}
+
+	_, err := internal.DB.Exec(`
+		INSERT OR REPLACE INTO taxa
+		(TaxonID, SynonymID, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus)
+		VALUES (` + strings.Join(DemoTaxa, ",") + ")")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = internal.DB.Exec(`
+		INSERT OR REPLACE INTO taxa
+		(TaxonID, SynonymID, SynonymName, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus, isSynonym)
+		VALUES  (` + strings.Join(DemoSyn, ",") + ")")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = internal.DB.Exec(`
+		INSERT OR REPLACE INTO observations
+		(TaxonID, ObservationID, ObservationDateOriginal, ObservationDate, CountryCode)
+		VALUES (` + strings.Join(DemoObservation, ",") + ")")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
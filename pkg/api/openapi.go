@@ -0,0 +1,204 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+	"github.com/labstack/echo/v4"
+)
+
+// Version of the API, bump on breaking changes together with the Prefix
+const Version = "1.0.0"
+
+var (
+	specOnce sync.Once
+	spec     map[string]any
+)
+
+func openAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, Spec())
+}
+
+// Spec returns the OpenAPI 3.0 document generated from the routes and the DTO types
+func Spec() map[string]any {
+	specOnce.Do(func() {
+		spec = buildSpec()
+	})
+	return spec
+}
+
+func buildSpec() map[string]any {
+	schemas := map[string]any{}
+	errorRef := schemaRef(reflect.TypeOf(Error{}), schemas)
+
+	paths := map[string]any{}
+	for _, r := range routes {
+		path := openAPIPath(r.path)
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[path] = item
+		}
+
+		var parameters []any
+		for _, p := range r.params {
+			schema := map[string]any{"type": p.kind}
+			if p.enum != nil {
+				schema["enum"] = p.enum
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.required,
+				"schema":      schema,
+			})
+		}
+
+		content := fileContent()
+		if r.response != nil {
+			content = jsonContent(schemaRef(reflect.TypeOf(r.response), schemas))
+		}
+		responses := map[string]any{
+			"200": map[string]any{
+				"description": "OK",
+				"content":     content,
+			},
+		}
+		for _, status := range append(r.errors, http.StatusInternalServerError) {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content":     jsonContent(errorRef),
+			}
+		}
+
+		operation := map[string]any{
+			"summary":     r.summary,
+			"operationId": operationID(r),
+			"responses":   responses,
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		item[strings.ToLower(r.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "GBIF Extinct API",
+			"version":     Version,
+			"description": "Latest GBIF observation per taxon and country. Errors always use the Error schema.",
+		},
+		"servers":    []any{map[string]any{"url": Prefix}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// Routes without response type return a file in one of the export formats
+func fileContent() map[string]any {
+	content := map[string]any{}
+	for _, format := range queries.ExportFormats {
+		_, contentType, _ := queries.ParseExportFormat(format)
+		content[contentType] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+	}
+	return content
+}
+
+// Convert echo ":id" parameters to OpenAPI "{id}"
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func operationID(r route) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(r.method))
+	for _, part := range strings.Split(r.path, "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, ":") {
+			part = "By" + part[1:]
+		}
+		id.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return id.String()
+}
+
+// Helper to get a reference to a named struct schema, the schema is added to the components on first use
+func schemaRef(t reflect.Type, schemas map[string]any) map[string]any {
+	if _, ok := schemas[t.Name()]; !ok {
+		schemas[t.Name()] = nil // placeholder against recursion
+		schemas[t.Name()] = structSchema(t, schemas)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.Anonymous && tag == "" {
+				addFields(field.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if name == "" || name == "-" || !field.IsExported() {
+				continue
+			}
+			schema := typeSchema(field.Type, schemas)
+			if doc := field.Tag.Get("doc"); doc != "" {
+				schema["description"] = doc
+			}
+			properties[name] = schema
+			required = append(required, name)
+		}
+	}
+	addFields(t)
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+func typeSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := typeSchema(t.Elem(), schemas)
+		if _, ok := schema["$ref"]; ok {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Struct:
+		return schemaRef(t, schemas)
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+	"github.com/labstack/echo/v4"
+)
+
+type param struct {
+	name        string
+	in          string
+	description string
+	kind        string
+	enum        []string
+	required    bool
+}
+
+var listParams = []param{
+	{name: "order_by", in: "query", description: "Sort column", kind: "string", enum: []string{"date", "name", "fetch"}},
+	{name: "order_dir", in: "query", description: "Sort direction", kind: "string", enum: []string{"asc", "desc"}},
+	{name: "search", in: "query", description: "Case insensitive part of the scientific name", kind: "string"},
+	{name: "country", in: "query", description: "Comma separated ISO 3166-1 alpha-2 country codes", kind: "string"},
+	{name: "exclude_country", in: "query", description: "Comma separated ISO 3166-1 alpha-2 country codes to exclude", kind: "string"},
+	{name: "region", in: "query", description: "Comma separated regions, continents, eu or GBIF regions, e.g. europe or gbif-latin-america", kind: "string"},
+	{name: "rank", in: "query", description: "Taxonomic rank used with the taxa filter", kind: "string", enum: []string{"kingdom", "phylum", "class", "order", "family"}},
+	{name: "taxa", in: "query", description: "Prefix of the taxon name at the given rank", kind: "string"},
+	{name: "page", in: "query", description: "Page number starting at 1, a page has 100 rows", kind: "integer"},
+	{name: "show_synonyms", in: "query", description: "Include synonyms", kind: "boolean"},
+	{name: "observed_before", in: "query", description: "Latest observation before this year or date (YYYY or YYYY-MM-DD), exclusive", kind: "string"},
+	{name: "observed_after", in: "query", description: "Latest observation on or after this year or date (YYYY or YYYY-MM-DD)", kind: "string"},
+	{name: "min_years", in: "query", description: "Minimum years since the latest observation", kind: "number"},
+	{name: "max_years", in: "query", description: "Maximum years since the latest observation", kind: "number"},
+}
+
+// Taxa have no observations, so the country and observation date filters and the date order are rejected instead of ignored
+var taxaParams = func() []param {
+	params := withoutParams(listParams, "country", "exclude_country", "region", "observed_before", "observed_after", "min_years", "max_years")
+	for i, p := range params {
+		if p.name == "order_by" {
+			params[i].description = "Sort column, name by default"
+			params[i].enum = []string{"name", "fetch"}
+		}
+	}
+	return params
+}()
+
+// Export takes the list filters without paging
+var exportParams = append(withoutParams(listParams, "page"),
+	param{name: "format", in: "query", description: "File format, csv by default", kind: "string", enum: queries.ExportFormats},
+	param{name: "columns", in: "query", description: "Comma separated column names, all columns by default", kind: "string"},
+)
+
+// Helper to copy the parameters without the given names
+func withoutParams(params []param, names ...string) []param {
+	return slices.DeleteFunc(slices.Clone(params), func(p param) bool {
+		return slices.Contains(names, p.name)
+	})
+}
+
+var idParam = param{name: "id", in: "path", description: "GBIF taxon key", kind: "integer", required: true}
+
+// Helper to build a query from the list parameters of the route, invalid values and list parameters the route does not take are rejected
+func parseQuery(c echo.Context, params []param) (queries.Query, error) {
+	q := queries.NewQuery(nil)
+	values := c.QueryParams()
+	for _, p := range listParams {
+		if !values.Has(p.name) {
+			continue
+		}
+		value := strings.TrimSpace(values.Get(p.name))
+		if value == "" {
+			continue
+		}
+		i := slices.IndexFunc(params, func(other param) bool { return other.name == p.name })
+		if i < 0 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, p.name+" is not supported by this endpoint")
+		}
+		p = params[i]
+		if p.enum != nil && !slices.Contains(p.enum, strings.ToLower(value)) {
+			return q, echo.NewHTTPError(http.StatusBadRequest, p.name+" must be one of "+strings.Join(p.enum, ", "))
+		}
+		switch p.name {
+		case "order_by":
+			q.ORDER_BY = strings.ToLower(value)
+		case "order_dir":
+			q.ORDER_DIR = strings.ToLower(value)
+		case "search":
+			q.SEARCH = value
+		case "country", "exclude_country":
+			if _, err := countries.ParseCodes(value); err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, p.name+": "+err.Error())
+			}
+			if p.name == "country" {
+				q.COUNTRY = value
+			} else {
+				q.EXCLUDE_COUNTRY = value
+			}
+		case "region":
+			if _, err := countries.ParseRegions(value); err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, p.name+": "+err.Error())
+			}
+			q.REGION = value
+		case "rank":
+			q.RANK = value
+		case "taxa":
+			q.TAXA = value
+		case "page":
+			page, err := strconv.Atoi(value)
+			if err != nil || page < 1 {
+				return q, echo.NewHTTPError(http.StatusBadRequest, "page must be a positive integer")
+			}
+			q.PAGE = value
+		case "observed_before", "observed_after":
+			if _, err := queries.ParseObservedDate(value); err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, p.name+": "+err.Error())
+			}
+			if p.name == "observed_before" {
+				q.OBSERVED_BEFORE = value
+			} else {
+				q.OBSERVED_AFTER = value
+			}
+		case "min_years", "max_years":
+			if _, err := queries.ParseYears(value); err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, p.name+": "+err.Error())
+			}
+			if p.name == "min_years" {
+				q.MIN_YEARS = value
+			} else {
+				q.MAX_YEARS = value
+			}
+		case "show_synonyms":
+			show, err := strconv.ParseBool(value)
+			if err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, "show_synonyms must be true or false")
+			}
+			q.SHOW_SYNONYMS = show
+		}
+	}
+	return q, nil
+}
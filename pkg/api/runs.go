@@ -0,0 +1,171 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+	"github.com/labstack/echo/v4"
+)
+
+// Days of failed attempts summarized in the refresh progress
+const fetchErrorDays = 7
+
+// FetchRun is one cron batch, manual fetch or CLI run
+type FetchRun struct {
+	RunID       int64   `json:"runID"`
+	TriggeredBy string  `json:"triggeredBy" doc:"cron, manual or cli"`
+	StartedAt   string  `json:"startedAt" doc:"RFC 3339"`
+	FinishedAt  *string `json:"finishedAt" doc:"RFC 3339, null while the run is going on"`
+	Attempted   int     `json:"attempted"`
+	Succeeded   int     `json:"succeeded" doc:"Taxa with updated observations"`
+	NotFound    int     `json:"notFound" doc:"Taxa without observations on GBIF"`
+	Failed      int     `json:"failed"`
+	Error       *string `json:"error" doc:"Error which stopped the run early, e.g. a GBIF rate limit"`
+}
+
+// FetchAttempt is the fetch of one taxon in a run
+type FetchAttempt struct {
+	TaxonID        string  `json:"taxonID" doc:"GBIF taxon key"`
+	ScientificName *string `json:"scientificName"`
+	StartedAt      string  `json:"startedAt" doc:"RFC 3339"`
+	DurationMs     int64   `json:"durationMs"`
+	Requests       int     `json:"requests" doc:"GBIF requests including retries"`
+	Countries      int     `json:"countries" doc:"Countries with a latest observation"`
+	ErrorType      *string `json:"errorType" doc:"not_found, rate_limited, upstream, save, canceled or other, null on success"`
+	StatusCode     *int64  `json:"statusCode" doc:"HTTP status of the failed GBIF request"`
+	Error          *string `json:"error"`
+}
+
+type FetchRunList struct {
+	Data       []FetchRun `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+// FetchRunDetail is a run with all its attempts
+type FetchRunDetail struct {
+	FetchRun
+	Attempts []FetchAttempt `json:"attempts"`
+}
+
+type FetchErrorCount struct {
+	ErrorType  string `json:"errorType"`
+	StatusCode *int64 `json:"statusCode"`
+	Count      int    `json:"count"`
+}
+
+// RefreshProgress of the accepted taxa of the backbone and the recent GBIF failures
+type RefreshProgress struct {
+	TotalTaxa    int               `json:"totalTaxa"`
+	FetchedTaxa  int               `json:"fetchedTaxa" doc:"Taxa fetched within the staleness window"`
+	DueTaxa      int               `json:"dueTaxa" doc:"Taxa waiting in the refresh queue"`
+	NeverFetched int               `json:"neverFetched"`
+	Percent      float64           `json:"percent"`
+	StaleMonths  int               `json:"staleMonths"`
+	Errors       []FetchErrorCount `json:"errors" doc:"Failed attempts of the past 7 days by error type and status code"`
+}
+
+var pageParam = param{name: "page", in: "query", description: "Page number starting at 1, a page has 100 runs", kind: "integer"}
+
+var runIDParam = param{name: "id", in: "path", description: "Fetch run id", kind: "integer", required: true}
+
+func listFetchRuns(c echo.Context) error {
+	page := 1
+	if value := c.QueryParam("page"); value != "" {
+		var err error
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "page must be a positive integer")
+		}
+	}
+	runs := queries.GetFetchRuns(internal.DB, page)
+	result := FetchRunList{
+		Data:       make([]FetchRun, 0, len(runs)),
+		Pagination: pagination(queries.Query{PAGE: strconv.Itoa(page)}, queries.GetFetchRunCount(internal.DB)),
+	}
+	for _, row := range runs {
+		result.Data = append(result.Data, NewFetchRun(row))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getFetchRun(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be a numeric run id")
+	}
+	run, err := queries.GetFetchRun(internal.DB, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "fetch run "+id+" not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	attempts := queries.GetFetchAttempts(internal.DB, id, false)
+	result := FetchRunDetail{FetchRun: NewFetchRun(run), Attempts: make([]FetchAttempt, 0, len(attempts))}
+	for _, row := range attempts {
+		result.Attempts = append(result.Attempts, NewFetchAttempt(row))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getRefreshProgress(c echo.Context) error {
+	progress := queries.GetRefreshProgress(internal.DB, gbif.RefreshStaleMonths)
+	result := RefreshProgress{
+		TotalTaxa:    progress.TotalTaxa,
+		FetchedTaxa:  progress.FetchedTaxa,
+		DueTaxa:      progress.DueTaxa(),
+		NeverFetched: progress.NeverFetched,
+		Percent:      math.Round(progress.Percent()*10) / 10,
+		StaleMonths:  progress.StaleMonths,
+		Errors:       []FetchErrorCount{},
+	}
+	for _, row := range queries.GetFetchErrorCounts(internal.DB, fetchErrorDays) {
+		result.Errors = append(result.Errors, FetchErrorCount{ErrorType: row.ErrorType, StatusCode: nullInt(row.StatusCode), Count: row.Count})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// NewFetchRun converts a fetch run row into its JSON representation
+func NewFetchRun(row queries.FetchRunRow) FetchRun {
+	return FetchRun{
+		RunID:       row.RunID,
+		TriggeredBy: row.TriggeredBy,
+		StartedAt:   row.StartedAt.UTC().Format(time.RFC3339),
+		FinishedAt:  nullTime(row.FinishedAt, time.RFC3339),
+		Attempted:   row.Attempted,
+		Succeeded:   row.Succeeded,
+		NotFound:    row.NotFound,
+		Failed:      row.Failed,
+		Error:       nullString(row.Error),
+	}
+}
+
+// NewFetchAttempt converts a fetch attempt row into its JSON representation
+func NewFetchAttempt(row queries.FetchAttemptRow) FetchAttempt {
+	return FetchAttempt{
+		TaxonID:        row.TaxonID,
+		ScientificName: nullString(row.ScientificName),
+		StartedAt:      row.StartedAt.UTC().Format(time.RFC3339),
+		DurationMs:     row.DurationMs,
+		Requests:       row.Requests,
+		Countries:      row.Countries,
+		ErrorType:      nullString(row.ErrorType),
+		StatusCode:     nullInt(row.StatusCode),
+		Error:          nullString(row.Error),
+	}
+}
+
+func nullInt(i sql.NullInt64) *int64 {
+	if !i.Valid {
+		return nil
+	}
+	return &i.Int64
+}
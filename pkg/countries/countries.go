@@ -0,0 +1,203 @@
+// Purpose: Bundled ISO 3166 country table with full names and region membership, used by the country and region filters
+package countries
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Tab separated table of ISO 3166-1 alpha-2 codes, the GBIF region is derived from the continent with Mexico,
+// Central America and the Caribbean counted as Latin America
+//
+//go:embed countries.tsv
+var table string
+
+type Country struct {
+	Code       string
+	Name       string
+	Continent  string
+	GbifRegion string
+	EU         bool
+}
+
+// Region is a named group of countries which can be used as filter, e.g. "europe" or "gbif-latin-america"
+type Region struct {
+	Key   string
+	Name  string
+	Codes []string
+}
+
+var (
+	all     []Country
+	byCode  = map[string]Country{}
+	regions []Region
+)
+
+var continents = []struct{ code, key, name string }{
+	{"AF", "africa", "Africa"},
+	{"AN", "antarctica", "Antarctica"},
+	{"AS", "asia", "Asia"},
+	{"EU", "europe", "Europe"},
+	{"NA", "north-america", "North America"},
+	{"OC", "oceania", "Oceania"},
+	{"SA", "south-america", "South America"},
+}
+
+var gbifRegions = []struct{ code, key, name string }{
+	{"AFRICA", "gbif-africa", "GBIF Africa"},
+	{"ANTARCTICA", "gbif-antarctica", "GBIF Antarctica"},
+	{"ASIA", "gbif-asia", "GBIF Asia"},
+	{"EUROPE", "gbif-europe", "GBIF Europe"},
+	{"LATIN_AMERICA", "gbif-latin-america", "GBIF Latin America"},
+	{"NORTH_AMERICA", "gbif-north-america", "GBIF North America"},
+	{"OCEANIA", "gbif-oceania", "GBIF Oceania"},
+}
+
+func init() {
+	for i, line := range strings.Split(table, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "Code\t") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			panic(fmt.Sprintf("countries.tsv line %d: expected 5 fields, got %d", i+1, len(fields)))
+		}
+		c := Country{Code: fields[0], Name: fields[1], Continent: fields[2], GbifRegion: fields[3], EU: fields[4] == "true"}
+		all = append(all, c)
+		byCode[c.Code] = c
+	}
+
+	for _, continent := range continents {
+		regions = append(regions, newRegion(continent.key, continent.name, func(c Country) bool { return c.Continent == continent.code }))
+	}
+	regions = append(regions, newRegion("eu", "European Union", func(c Country) bool { return c.EU }))
+	for _, region := range gbifRegions {
+		regions = append(regions, newRegion(region.key, region.name, func(c Country) bool { return c.GbifRegion == region.code }))
+	}
+}
+
+func newRegion(key, name string, member func(Country) bool) Region {
+	r := Region{Key: key, Name: name}
+	for _, c := range all {
+		if member(c) {
+			r.Codes = append(r.Codes, c.Code)
+		}
+	}
+	return r
+}
+
+// All countries sorted by code
+func All() []Country {
+	return all
+}
+
+// Get a country by its upper case alpha-2 code
+func Get(code string) (Country, bool) {
+	c, ok := byCode[code]
+	return c, ok
+}
+
+// Name of the country or the code itself if it is unknown
+func Name(code string) string {
+	if c, ok := byCode[code]; ok {
+		return c.Name
+	}
+	return code
+}
+
+// Regions in display order, continents first followed by the EU and the GBIF regions
+func Regions() []Region {
+	return regions
+}
+
+// GetRegion by its key, the key is case insensitive
+func GetRegion(key string) (Region, bool) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	for _, r := range regions {
+		if r.Key == key {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+// ParseCodes splits a comma separated list of country codes, the codes are upper cased and must be known
+func ParseCodes(value string) ([]string, error) {
+	var codes []string
+	for _, part := range strings.Split(value, ",") {
+		code := strings.ToUpper(strings.TrimSpace(part))
+		if code == "" {
+			continue
+		}
+		if _, ok := byCode[code]; !ok {
+			return nil, fmt.Errorf("unknown country code %q, use ISO 3166-1 alpha-2 codes", part)
+		}
+		if !slices.Contains(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
+}
+
+// ParseRegions splits a comma separated list of region keys and returns the codes of all member countries
+func ParseRegions(value string) ([]string, error) {
+	var codes []string
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		r, ok := GetRegion(part)
+		if !ok {
+			return nil, fmt.Errorf("unknown region %q", part)
+		}
+		for _, code := range r.Codes {
+			if !slices.Contains(codes, code) {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes, nil
+}
+
+// Country outlines from Natural Earth 1:110m Admin 0 (public domain), coordinates rounded to two decimals
+//
+//go:embed shapes.geojson
+var shapesGeoJSON []byte
+
+// Shape is the outline of a country as multipolygon of longitude, latitude pairs, the first ring of a polygon is the outer one
+type Shape struct {
+	Code     string
+	Polygons [][][][2]float64
+}
+
+var (
+	shapesOnce sync.Once
+	shapes     []Shape
+)
+
+// Shapes of all countries large enough for the 1:110m scale, sorted by code
+func Shapes() []Shape {
+	shapesOnce.Do(func() {
+		var collection struct {
+			Features []struct {
+				Properties struct {
+					Code string `json:"code"`
+				} `json:"properties"`
+				Geometry struct {
+					Coordinates [][][][2]float64 `json:"coordinates"`
+				} `json:"geometry"`
+			} `json:"features"`
+		}
+		if err := json.Unmarshal(shapesGeoJSON, &collection); err != nil {
+			panic(fmt.Sprintf("shapes.geojson: %v", err))
+		}
+		for _, f := range collection.Features {
+			shapes = append(shapes, Shape{Code: f.Properties.Code, Polygons: f.Geometry.Coordinates})
+		}
+	})
+	return shapes
+}
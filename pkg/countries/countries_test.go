@@ -0,0 +1,67 @@
+package countries
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	if len(All()) != 251 {
+		t.Errorf("got %d, wanted %d", len(All()), 251)
+	}
+	if Name("AT") != "Austria" {
+		t.Errorf("got %s, wanted %s", Name("AT"), "Austria")
+	}
+	if Name("QQ") != "QQ" {
+		t.Errorf("got %s, wanted %s", Name("QQ"), "QQ")
+	}
+	for _, c := range All() {
+		if c.Code != "ZZ" && (c.Continent == "" || c.GbifRegion == "") {
+			t.Errorf("got %v, wanted continent and GBIF region", c)
+		}
+	}
+}
+
+func TestRegions(t *testing.T) {
+	eu, ok := GetRegion("EU")
+	if !ok || len(eu.Codes) != 27 {
+		t.Errorf("got %d, wanted %d", len(eu.Codes), 27)
+	}
+	latin, _ := GetRegion("gbif-latin-america")
+	if !slices.Contains(latin.Codes, "MX") || !slices.Contains(latin.Codes, "BR") || slices.Contains(latin.Codes, "US") {
+		t.Errorf("got %v, wanted MX and BR without US", latin.Codes)
+	}
+	if _, ok := GetRegion("atlantis"); ok {
+		t.Errorf("got %t, wanted %t", ok, false)
+	}
+}
+
+func TestParse(t *testing.T) {
+	codes, err := ParseCodes(" at,de, AT,")
+	if err != nil || !slices.Equal(codes, []string{"AT", "DE"}) {
+		t.Errorf("got %v %v, wanted %v", codes, err, []string{"AT", "DE"})
+	}
+	if _, err := ParseCodes("AT,XX"); err == nil {
+		t.Errorf("got %v, wanted error", err)
+	}
+
+	codes, err = ParseRegions("antarctica,eu")
+	if err != nil || !slices.Contains(codes, "AQ") || !slices.Contains(codes, "AT") || slices.Contains(codes, "CH") {
+		t.Errorf("got %v %v, wanted AQ and AT without CH", codes, err)
+	}
+	if _, err := ParseRegions("europe,atlantis"); err == nil {
+		t.Errorf("got %v, wanted error", err)
+	}
+}
+
+func TestShapes(t *testing.T) {
+	shapes := Shapes()
+	if len(shapes) != 175 {
+		t.Errorf("got %d, wanted %d", len(shapes), 175)
+	}
+	for _, shape := range shapes {
+		if _, ok := Get(shape.Code); !ok || len(shape.Polygons) == 0 {
+			t.Errorf("got %s with %d polygons, wanted known code", shape.Code, len(shape.Polygons))
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package gbif
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultBaseURL           = "https://api.gbif.org/v1"
+	DefaultUserAgent         = "gbif-extinct"
+	DefaultTimeout           = 2 * time.Second
+	DefaultRequestsPerSecond = 1.0
+	DefaultMaxRetries        = 3
+	DefaultWorkers           = 4
+	DefaultBackoffBase       = 500 * time.Millisecond
+	DefaultBackoffMax        = 30 * time.Second
+	DefaultRetryAfterMax     = 5 * time.Minute
+)
+
+// Pages on the GBIF website, the occurrence or taxon key is appended
+const (
+	OccurrenceURL = "https://www.gbif.org/occurrence/"
+	SpeciesURL    = "https://www.gbif.org/species/"
+)
+
+var (
+	// ErrRateLimited is returned if GBIF still answers with 429 after all retries or asks to wait longer than RetryAfterMax
+	ErrRateLimited = errors.New("gbif: rate limited")
+	// ErrNotFound is returned if GBIF has no data for the request
+	ErrNotFound = errors.New("gbif: no data found")
+	// ErrUpstream is returned for timeouts, 5xx responses and unreadable bodies
+	ErrUpstream = errors.New("gbif: upstream error")
+)
+
+// RequestError wraps one of the Err* errors with the details of the failed request
+type RequestError struct {
+	URL        string
+	StatusCode int
+	Err        error
+	Cause      error
+}
+
+func (e *RequestError) Error() string {
+	msg := e.Err.Error() + ": " + e.URL
+	if e.StatusCode != 0 {
+		msg += " (status " + strconv.Itoa(e.StatusCode) + ")"
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Config for a new GBIF client, zero values fall back to the package defaults
+type Config struct {
+	UserAgentPrefix   string
+	BaseURL           string
+	Timeout           time.Duration
+	RequestsPerSecond float64
+	MaxRetries        int
+	RetryAfterMax     time.Duration
+	Workers           int
+}
+
+// Client talks to the GBIF occurrence API. All requests share the same rate limiter,
+// so one client should be used per process to stay polite towards GBIF.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Limiter    *rate.Limiter
+	UserAgent  string
+
+	MaxRetries  int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Longest Retry-After which is waited for, the request fails if GBIF asks for more
+	RetryAfterMax time.Duration
+
+	// Workers is the number of countries which are paged concurrently in FetchLatest
+	Workers int
+}
+
+// NewClient creates a GBIF client from the given configuration
+func NewClient(config Config) *Client {
+	baseURL := DefaultBaseURL
+	if config.BaseURL != "" {
+		baseURL = strings.TrimSuffix(config.BaseURL, "/")
+	}
+	userAgent := DefaultUserAgent
+	if config.UserAgentPrefix != "" {
+		userAgent = config.UserAgentPrefix + "_" + userAgent
+	}
+	timeout := DefaultTimeout
+	if config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+	requestsPerSecond := DefaultRequestsPerSecond
+	if config.RequestsPerSecond > 0 {
+		requestsPerSecond = config.RequestsPerSecond
+	}
+	maxRetries := DefaultMaxRetries
+	if config.MaxRetries > 0 {
+		maxRetries = config.MaxRetries
+	}
+	retryAfterMax := DefaultRetryAfterMax
+	if config.RetryAfterMax > 0 {
+		retryAfterMax = config.RetryAfterMax
+	}
+	workers := DefaultWorkers
+	if config.Workers > 0 {
+		workers = config.Workers
+	}
+
+	return &Client{
+		BaseURL:       baseURL,
+		HTTPClient:    &http.Client{Timeout: timeout},
+		Limiter:       rate.NewLimiter(rate.Limit(requestsPerSecond), 1),
+		UserAgent:     userAgent,
+		MaxRetries:    maxRetries,
+		BackoffBase:   DefaultBackoffBase,
+		BackoffMax:    DefaultBackoffMax,
+		RetryAfterMax: retryAfterMax,
+		Workers:       workers,
+	}
+}
+
+// Helper function to run a GET request against the GBIF API. Each attempt waits for the rate limiter,
+// timeouts, 429 and 5xx responses are retried with jittered exponential backoff. A Retry-After of GBIF is waited for in full,
+// if it is longer than RetryAfterMax the request fails without another try.
+func (c *Client) fetch(ctx context.Context, url string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		var body []byte
+		var retryAfter time.Duration
+		body, retryAfter, err = c.fetchOnce(ctx, url)
+		if err == nil {
+			return body, nil
+		}
+		if !retryable(err) || attempt == c.MaxRetries {
+			break
+		}
+
+		if retryAfter > c.RetryAfterMax {
+			slog.Warn("Giving up gbif request, Retry-After too long", "url", url, "retryAfter", retryAfter, "error", err)
+			var reqErr *RequestError
+			if errors.As(err, &reqErr) {
+				reqErr.Err = ErrRateLimited
+			}
+			break
+		}
+		wait := max(c.backoff(attempt), retryAfter)
+		slog.Warn("Retrying gbif request", "url", url, "attempt", attempt+1, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil, err
+}
+
+// Helper function to run a single request, returns the Retry-After duration if GBIF sent one
+func (c *Client) fetchOnce(ctx context.Context, url string) ([]byte, time.Duration, error) {
+	err := c.Limiter.Wait(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	countRequest(ctx)
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		metrics.GbifRequests.WithLabelValues("error").Inc()
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, &RequestError{URL: url, Err: ErrUpstream, Cause: err}
+	}
+	defer res.Body.Close()
+	metrics.GbifRequests.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, &RequestError{URL: url, StatusCode: res.StatusCode, Err: ErrUpstream, Cause: err}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return body, 0, nil
+	case res.StatusCode == http.StatusNotFound:
+		return nil, 0, &RequestError{URL: url, StatusCode: res.StatusCode, Err: ErrNotFound}
+	case res.StatusCode == http.StatusTooManyRequests:
+		return nil, parseRetryAfter(res.Header.Get("Retry-After")), &RequestError{URL: url, StatusCode: res.StatusCode, Err: ErrRateLimited}
+	case res.StatusCode == http.StatusServiceUnavailable:
+		return nil, parseRetryAfter(res.Header.Get("Retry-After")), &RequestError{URL: url, StatusCode: res.StatusCode, Err: ErrUpstream}
+	default:
+		return nil, 0, &RequestError{URL: url, StatusCode: res.StatusCode, Err: ErrUpstream}
+	}
+}
+
+// Exponential backoff with full jitter, capped at BackoffMax
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.BackoffBase << attempt
+	if wait <= 0 || wait > c.BackoffMax {
+		wait = c.BackoffMax
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return rand.N(wait)
+}
+
+// Only rate limits, server errors and network failures are worth another try
+func retryable(err error) bool {
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	if errors.Is(reqErr, ErrRateLimited) {
+		return true
+	}
+	return errors.Is(reqErr, ErrUpstream) && (reqErr.StatusCode == 0 || reqErr.StatusCode >= 500)
+}
+
+// Retry-After can either be delay seconds or a HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Helper to wrap JSON decoding errors as upstream errors, GBIF sometimes answers with HTML error pages
+func invalidBody(url string, err error) error {
+	return &RequestError{URL: url, Err: ErrUpstream, Cause: fmt.Errorf("invalid json: %w", err)}
+}
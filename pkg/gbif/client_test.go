@@ -0,0 +1,181 @@
+package gbif
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif/gbiftest"
+	"golang.org/x/time/rate"
+)
+
+// Helper to create a client pointing to a test server without rate limit and short backoff
+func newTestClient(url string) *Client {
+	client := NewClient(Config{BaseURL: url, MaxRetries: 2})
+	client.Limiter = rate.NewLimiter(rate.Inf, 1)
+	client.BackoffBase = time.Millisecond
+	client.BackoffMax = 10 * time.Millisecond
+	return client
+}
+
+func TestNewClient(t *testing.T) {
+	client := NewClient(Config{})
+	if client.BaseURL != DefaultBaseURL {
+		t.Errorf("got %s, wanted %s", client.BaseURL, DefaultBaseURL)
+	}
+	if client.UserAgent != DefaultUserAgent {
+		t.Errorf("got %s, wanted %s", client.UserAgent, DefaultUserAgent)
+	}
+	if client.Workers != DefaultWorkers {
+		t.Errorf("got %d, wanted %d", client.Workers, DefaultWorkers)
+	}
+
+	client = NewClient(Config{UserAgentPrefix: "test", BaseURL: "http://localhost:8080/", Timeout: 5 * time.Second, RequestsPerSecond: 10, Workers: 2})
+	if client.BaseURL != "http://localhost:8080" {
+		t.Errorf("got %s, wanted %s", client.BaseURL, "http://localhost:8080")
+	}
+	if client.UserAgent != "test_"+DefaultUserAgent {
+		t.Errorf("got %s, wanted %s", client.UserAgent, "test_"+DefaultUserAgent)
+	}
+	if client.HTTPClient.Timeout != 5*time.Second {
+		t.Errorf("got %v, wanted %v", client.HTTPClient.Timeout, 5*time.Second)
+	}
+	if client.Limiter.Limit() != 10 {
+		t.Errorf("got %v, wanted %v", client.Limiter.Limit(), 10)
+	}
+	if client.Workers != 2 {
+		t.Errorf("got %d, wanted %d", client.Workers, 2)
+	}
+}
+
+func TestFetchRetry(t *testing.T) {
+	server := gbiftest.NewServer()
+	defer server.Close()
+	server.Fail(gbiftest.Failure{Status: http.StatusServiceUnavailable, RetryAfter: "0"})
+
+	body, err := newTestClient(server.URL).fetch(context.Background(), endpoint)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if len(body) == 0 {
+		t.Errorf("got %s, wanted %s", body, "body")
+	}
+	if server.Requests() != 2 {
+		t.Errorf("got %d, wanted %d", server.Requests(), 2)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+		calls  int
+	}{
+		{http.StatusTooManyRequests, ErrRateLimited, 3},
+		{http.StatusInternalServerError, ErrUpstream, 3},
+		{http.StatusNotFound, ErrNotFound, 1},
+		{http.StatusBadRequest, ErrUpstream, 1},
+	}
+
+	for _, test := range tests {
+		server := gbiftest.NewServer()
+		server.Fail(gbiftest.Failure{Status: test.status, Times: 10})
+
+		_, err := newTestClient(server.URL).fetch(context.Background(), endpoint)
+		if !errors.Is(err, test.want) {
+			t.Errorf("got %v, wanted %v", err, test.want)
+		}
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) || reqErr.StatusCode != test.status {
+			t.Errorf("got %v, wanted status %d", err, test.status)
+		}
+		if server.Requests() != test.calls {
+			t.Errorf("got %d, wanted %d", server.Requests(), test.calls)
+		}
+		server.Close()
+	}
+}
+
+func TestFetchRetryAfter(t *testing.T) {
+	server := gbiftest.NewServer()
+	defer server.Close()
+	server.Fail(gbiftest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "1"})
+
+	/* Retry-After is longer than BackoffMax and still waited for in full */
+	start := time.Now()
+	_, err := newTestClient(server.URL).fetch(context.Background(), endpoint)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("got %v, wanted at least %v", time.Since(start), time.Second)
+	}
+	if server.Requests() != 2 {
+		t.Errorf("got %d, wanted %d", server.Requests(), 2)
+	}
+
+	/* Longer than RetryAfterMax gives up without another try */
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		server := gbiftest.NewServer()
+		server.Fail(gbiftest.Failure{Status: status, RetryAfter: "120", Times: 10})
+		client := newTestClient(server.URL)
+		client.RetryAfterMax = time.Minute
+		_, err = client.fetch(context.Background(), endpoint)
+		if !errors.Is(err, ErrRateLimited) {
+			t.Errorf("got %v, wanted %v", err, ErrRateLimited)
+		}
+		if server.Requests() != 1 {
+			t.Errorf("got %d, wanted %d", server.Requests(), 1)
+		}
+		server.Close()
+	}
+}
+
+func TestFetchLatestInvalidJSON(t *testing.T) {
+	server := gbiftest.NewServer()
+	defer server.Close()
+	server.Fail(gbiftest.Failure{Body: "<html>Bad Gateway</html>"})
+
+	res, err := newTestClient(server.URL).FetchLatest(context.Background(), "4560445")
+	if res != nil {
+		t.Errorf("got %v, wanted %v", res, nil)
+	}
+	if !errors.Is(err, ErrUpstream) {
+		t.Errorf("got %v, wanted %v", err, ErrUpstream)
+	}
+}
+
+func TestFetchCancel(t *testing.T) {
+	server := gbiftest.NewServer()
+	defer server.Close()
+	server.Fail(gbiftest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "60", Times: 10})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	client := newTestClient(server.URL)
+	client.BackoffMax = time.Minute
+	start := time.Now()
+	_, err := client.fetch(ctx, endpoint)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("got %v, wanted fetch to stop with the context", time.Since(start))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("5"); got != 5*time.Second {
+		t.Errorf("got %v, wanted %v", got, 5*time.Second)
+	}
+	if got := parseRetryAfter(""); got != 0 {
+		t.Errorf("got %v, wanted %v", got, 0)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 0 || got > time.Minute {
+		t.Errorf("got %v, wanted between 0 and %v", got, time.Minute)
+	}
+}
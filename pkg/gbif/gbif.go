@@ -3,30 +3,32 @@
 package gbif
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"log/slog"
-	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/metrics"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	api              = "https://api.gbif.org/v1"
-	userAgent        = "gbif-extinct"
 	endpoint         = "/occurrence/search"
 	limit            = 300
 	basisOfRecord    = "basis_of_record=MACHINE_OBSERVATION&basis_of_record=OBSERVATION&basis_of_record=HUMAN_OBSERVATION&basis_of_record=PRESERVED_SPECIMEN"
 	occurrenceStatus = "occurrenceStatus=PRESENT"
 )
 
-const SampleRows = "25"
+const updateLastFetchQuery = "UPDATE taxa SET LastFetch = ? WHERE SynonymID = ? OR TaxonID = ?"
 
 // Response is the response from the GBIF API for the occurrence search
 type Response struct {
@@ -54,6 +56,9 @@ type Count struct {
 	Count int
 }
 
+// Column order of the observations and import table used for bulk inserts of LatestObservation values
+var ObservationColumns = []string{"ObservationID", "TaxonID", "CountryCode", "ObservationDate", "ObservationDateOriginal"}
+
 type LatestObservation struct {
 	ObservationID           string
 	ObservationOriginalDate string
@@ -62,225 +67,299 @@ type LatestObservation struct {
 	TaxonID                 string
 }
 
-type Config struct {
-	UserAgentPrefix string
-}
-
-// Updates the configuration for the GBIF package
-func UpdateConfig(config Config) {
-	if config.UserAgentPrefix != "" {
-		userAgent = config.UserAgentPrefix + "_" + userAgent
-	}
-}
-
-// FetchLatest fetches the latest observations of a taxon from the GBIF API
-func FetchLatest(taxonID string) *[]LatestObservation {
+// FetchLatest fetches the latest observations of a taxon from the GBIF API.
+// It returns ErrNotFound if GBIF has no observations for the taxon, any other error means GBIF could not be reached
+// and the result should not be treated as "no data".
+func (c *Client) FetchLatest(ctx context.Context, taxonID string) (_ *[]LatestObservation, err error) {
 	slog.Info("Fetching latest observations from gbif", "taxonID", taxonID)
-	years := getYears(taxonID)
+	start := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = ErrorType(err)
+		}
+		metrics.FetchLatestDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	}()
+	years, err := c.getYears(ctx, taxonID)
+	if err != nil {
+		return nil, err
+	}
 	if len(years) == 0 {
 		slog.Info("No year data found for taxon")
-		return nil
+		return nil, ErrNotFound
 	}
-	countries := getCountries(taxonID, years)
+	countries, err := c.getCountries(ctx, taxonID, years)
+	if err != nil {
+		return nil, err
+	}
+	foundFacets(ctx, len(years), len(countries))
 
-	baseUrl := endpoint + "?limit=" + fmt.Sprint(limit) + "&" + basisOfRecord + "&" + occurrenceStatus + "&" + "taxonKey=" + taxonID
+	var mu sync.Mutex
 	var result = &[]LatestObservation{}
+
+	// Countries are paged concurrently, the shared rate limiter of the client keeps the load on GBIF constant
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(c.Workers)
 	for key, year := range countries {
-		i := 0
-		var observations []LatestObservation
-		for {
-			offset := i * limit
-			i++
-
-			var response Response
-			fetchUrl := baseUrl + "&year=" + year + "&country=" + key + "&offset=" + fmt.Sprint(offset)
-			body := internalFetch(fetchUrl)
-			if body == nil {
-				log.Default().Println("Failed to fetch data with Url: " + fetchUrl)
-				break
+		g.Go(func() error {
+			latest, err := c.getLatestForCountry(gctx, taxonID, key, year)
+			if err != nil || latest == nil {
+				return err
 			}
-			json.Unmarshal(body, &response)
-			breakEarly := false
+			mu.Lock()
+			*result = append(*result, *latest)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
-			if response.Count < 0 {
-				slog.Info("No more rows found for given taxa", "taxonID", taxonID)
-				break
-			} else {
-				for _, result := range response.Results {
+	sort.Slice(*result, func(a, b int) bool {
+		return (*result)[a].CountryCode < (*result)[b].CountryCode
+	})
 
-					if len(result.EventDate) < 4 {
-						continue
-					}
+	return result, nil
+}
 
-					cleanDate := CleanDate(result.EventDate)
+// Helper function to page through the observations of one country and year, returns the latest observation or nil if none has a usable date
+func (c *Client) getLatestForCountry(ctx context.Context, taxonID string, country string, year string) (*LatestObservation, error) {
+	baseUrl := endpoint + "?limit=" + fmt.Sprint(limit) + "&" + basisOfRecord + "&" + occurrenceStatus + "&" + "taxonKey=" + taxonID
+	i := 0
+	var observations []LatestObservation
+	for {
+		offset := i * limit
+		i++
 
-					if len(observations) > 1 && cleanDate <= observations[len(observations)-1].ObservationDate {
-						continue
-					}
+		var response Response
+		fetchUrl := baseUrl + "&year=" + year + "&country=" + country + "&offset=" + fmt.Sprint(offset)
+		body, err := c.fetch(ctx, fetchUrl)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return nil, invalidBody(fetchUrl, err)
+		}
+		countPage(ctx, country)
+		breakEarly := false
 
-					observations = append(observations, LatestObservation{
-						ObservationID:           fmt.Sprint(result.Key),
-						ObservationOriginalDate: result.EventDate,
-						ObservationDate:         cleanDate,
-						CountryCode:             key,
-						TaxonID:                 taxonID,
-					})
-
-					// Escape hatch if we already on the last day of the year
-					if len(result.EventDate) >= 10 {
-						breakYear := result.EventDate[:4]
-						breakDay := breakYear + "-12-31"
-						if result.EventDate[:10] >= breakDay {
-							breakEarly = true
-							break
-						}
-					}
+		if response.Count < 0 {
+			slog.Info("No more rows found for given taxa", "taxonID", taxonID)
+			break
+		} else {
+			for _, result := range response.Results {
 
+				if len(result.EventDate) < 4 {
+					continue
 				}
-			}
 
-			if response.EndOfRecords || breakEarly {
-				break
-			}
+				cleanDate := CleanDate(result.EventDate)
+
+				if len(observations) > 1 && cleanDate <= observations[len(observations)-1].ObservationDate {
+					continue
+				}
+
+				observations = append(observations, LatestObservation{
+					ObservationID:           fmt.Sprint(result.Key),
+					ObservationOriginalDate: result.EventDate,
+					ObservationDate:         cleanDate,
+					CountryCode:             country,
+					TaxonID:                 taxonID,
+				})
+
+				// Escape hatch if we already on the last day of the year
+				if len(result.EventDate) >= 10 {
+					breakYear := result.EventDate[:4]
+					breakDay := breakYear + "-12-31"
+					if result.EventDate[:10] >= breakDay {
+						breakEarly = true
+						break
+					}
+				}
 
-			time.Sleep(1 * time.Second) // Prevent overload of the GBIF API
+			}
 		}
 
-		sort.Slice(observations, func(a, b int) bool {
-			return observations[b].ObservationDate < observations[a].ObservationDate
-		})
-		if len(observations) > 0 {
-			*result = append(*result, observations[0])
+		if response.EndOfRecords || breakEarly {
+			break
 		}
+	}
+
+	sort.Slice(observations, func(a, b int) bool {
+		return observations[b].ObservationDate < observations[a].ObservationDate
+	})
+	if len(observations) > 0 {
+		return &observations[0], nil
+	}
+	return nil, nil
+}
+
+// RefreshResult summarizes a RefreshTaxa batch, Failed holds the error for each taxon which could not be fetched or saved
+type RefreshResult struct {
+	Attempted int
+	Updated   int
+	NotFound  int
+	Failed    map[string]error
+}
 
+// Err joins the errors of all failed taxa, nil if all taxa succeeded
+func (r RefreshResult) Err() error {
+	var errs []error
+	for id, err := range r.Failed {
+		errs = append(errs, fmt.Errorf("taxon %s: %w", id, err))
+	}
+	return errors.Join(errs...)
+}
+
+// RefreshTaxa fetches the latest observations for the given taxa and saves them, this is the flow of the cron job.
+// Taxa without data on GBIF are marked as fetched, taxa which failed are kept for the next run.
+// The batch stops early if GBIF rate limits us or the context is canceled, this is returned as error
+// while failures of single taxa are reported in the result. Each call is stored as fetch run with the given trigger.
+func (c *Client) RefreshTaxa(ctx context.Context, db *sql.DB, trigger string, taxonIDs []string) (result RefreshResult, err error) {
+	result = RefreshResult{Failed: map[string]error{}}
+	runID := startRun(ctx, db, trigger)
+	defer func() { finishRun(ctx, db, runID, result, err) }()
+
+	for _, id := range taxonIDs {
+		result.Attempted++
+		err := c.RefreshTaxon(ctx, db, runID, id)
+		if ctx.Err() != nil {
+			slog.Info("Refresh canceled", "error", ctx.Err())
+			return result, ctx.Err()
+		}
+		if errors.Is(err, ErrNotFound) {
+			slog.Info("No data found on GBIF", "taxonID", id)
+			result.NotFound++
+			continue
+		}
+		if errors.Is(err, ErrRateLimited) {
+			slog.Warn("GBIF rate limited refresh, stopping batch", "taxonID", id, "error", err)
+			result.Failed[id] = err
+			return result, err
+		}
+		if err != nil {
+			slog.Error("Failed to refresh taxon", "taxonID", id, "error", err)
+			result.Failed[id] = err
+			continue
+		}
+		result.Updated++
 	}
 
-	return result
+	slog.Info("Refresh finished", "attempted", result.Attempted, "updated", result.Updated, "notFound", result.NotFound, "failed", len(result.Failed))
+	return result, nil
 }
 
-// SaveObservation saves the latest observation for each taxon
-// It first clears the old observations for each taxon before inserting the new ones
-// to improve performance each insert contains alls new observations for this taxa at once
-func SaveObservation(observation *[][]LatestObservation, db *sql.DB) {
+// SaveObservation saves the latest observation for each taxon, see SaveTaxonObservations.
+// A failing taxon does not stop the others, the returned error joins the errors of all failed taxa.
+func SaveObservation(ctx context.Context, observation *[][]LatestObservation, db *sql.DB) error {
 	slog.Info("Updating observations", "taxa", len(*observation))
-	const stmt = "INSERT INTO observations (ObservationID, TaxonID, CountryCode, ObservationDate, ObservationDateOriginal) VALUES"
+	var errs []error
 	for _, res := range *observation {
-		var insertString []string
-		clearOldObservations(db, res[0].TaxonID)
-		slog.Info("Inserting new for taxaId", "observations", len(res), "taxaId", res[0].TaxonID)
-		for _, obs := range res {
-			insertString = append(insertString, fmt.Sprintf("('%s', '%s', '%s', '%s', '%s')", obs.ObservationID, obs.TaxonID, obs.CountryCode, obs.ObservationDate, obs.ObservationOriginalDate))
+		if len(res) == 0 {
+			continue
 		}
-		query := stmt + strings.Join(insertString, ",") + " ON CONFLICT DO NOTHING;"
-		_, err := db.Exec(query)
+		err := SaveTaxonObservations(ctx, db, res[0].TaxonID, res)
 		if err != nil {
-			slog.Error("Database error on inserting new observations", err)
+			slog.Error("Database error on saving observations", "taxonID", res[0].TaxonID, "error", err)
+			errs = append(errs, fmt.Errorf("taxon %s: %w", res[0].TaxonID, err))
 		}
 	}
+	return errors.Join(errs...)
 }
 
-// Get the synonym id for a taxon id, this is used if fetch is called on a synonym
-func GetSynonymID(db *sql.DB, taxonID string) (string, error) {
-	var synonymID sql.NullString
-	err := db.QueryRow("SELECT SynonymID FROM taxa WHERE TaxonID = ?", taxonID).Scan(&synonymID)
+// SaveTaxonObservations replaces the observations of one taxon, appends the changes to observation_history,
+// records rediscoveries and updates its LastFetch in a single transaction. If anything fails the taxon keeps its old observations.
+func SaveTaxonObservations(ctx context.Context, db *sql.DB, taxonID string, observations []LatestObservation) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		slog.Error("Failed to get SynonymID", "error", err)
-		return "", errors.New("failed to fetch")
-	}
-	if !synonymID.Valid {
-		return "", errors.New("no id found")
+		return err
 	}
-	return synonymID.String, nil
-}
+	defer tx.Rollback()
 
-// Helper function to get outdated observations at random
-// We only want to fetch a few at a time to not overload the GBIF API
-// This function is used by the cron job
-func GetOutdatedObservations(db *sql.DB) []string {
-	rows, err := db.Query(`
-		SELECT TaxonID 
-		FROM taxa  
-		WHERE (6 > date_diff('month', today(), LastFetch) OR LastFetch IS NULL) AND isSynonym = FALSE
-		USING SAMPLE ` + SampleRows + ` ROWS`)
-	var taxonIDs []string
+	now := time.Now().UTC().Truncate(time.Microsecond) // DuckDB timestamp precision, history rows are matched by it
+	err = recordHistory(ctx, tx, taxonID, observations, now)
 	if err != nil {
-		slog.Error("Failed to get outdated observations", "error", err)
-		return taxonIDs
+		return err
 	}
-	for rows.Next() {
-		var taxonID string
-		err = rows.Scan(&taxonID)
-		if err != nil {
-			log.Fatal(err)
-		}
-		taxonIDs = append(taxonIDs, taxonID)
+	found, err := RecordRediscoveries(ctx, tx, now, RediscoveryGapYears)
+	if err != nil {
+		return err
+	}
+	if found > 0 {
+		slog.Info("Rediscovery detected", "taxaId", taxonID, "countries", found)
 	}
 
-	return taxonIDs
-}
-
-// UpdateLastFetchStatus updates the last fetch status for a taxon
-// this function should be called before updating the observations for a taxon
-// The LastFetch column is used to determine if a taxon should be fetched at random by the GetOutdatedObservations function
-func UpdateLastFetchStatus(db *sql.DB, taxonID string) bool {
-	now := time.Now().UTC().Format(time.RFC3339)
-	_, err := db.Exec("UPDATE taxa SET LastFetch = ? WHERE SynonymID = ? OR TaxonID = ?", now, taxonID, taxonID)
+	err = clearOldObservations(ctx, tx, taxonID, observations)
 	if err != nil {
-		slog.Error("Failed to update last fetch status", "error", err)
-		return false
+		return err
 	}
-	return true
-}
 
-func internalFetch(url string) []byte {
-	client := http.Client{
-		Timeout: time.Second * 2,
+	slog.Info("Inserting new for taxaId", "observations", len(observations), "taxaId", taxonID)
+	writer := internal.NewBulkWriter(tx, "observations", ObservationColumns, internal.ConflictReplace)
+	for _, obs := range observations {
+		err = writer.Add(ctx, obs.ObservationID, obs.TaxonID, obs.CountryCode, obs.ObservationDate, obs.ObservationOriginalDate)
+		if err != nil {
+			return err
+		}
 	}
-	req, err := http.NewRequest(http.MethodGet, api+url, nil)
+	err = writer.Flush(ctx)
 	if err != nil {
-		log.Default().Printf("Failed to fetch data: %s", err)
-		return nil
+		return err
 	}
-	req.Header.Set("User-Agent", userAgent)
 
-	res, getErr := client.Do(req)
-	if getErr != nil {
-		log.Default().Printf("Failed to fetch data: %s", getErr)
-		return nil
+	_, err = tx.ExecContext(ctx, updateLastFetchQuery, now.Format(time.RFC3339), taxonID, taxonID)
+	if err != nil {
+		return err
 	}
 
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
+	return tx.Commit()
+}
 
-	body, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		log.Default().Printf("Failed to read body: %s", readErr)
-		return nil
+// Get the synonym id for a taxon id, this is used if fetch is called on a synonym
+func GetSynonymID(ctx context.Context, db *sql.DB, taxonID string) (string, error) {
+	var synonymID sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT SynonymID FROM taxa WHERE TaxonID = ?", taxonID).Scan(&synonymID)
+	if err != nil {
+		slog.Error("Failed to get SynonymID", "error", err)
+		return "", errors.New("failed to fetch")
 	}
-
-	if res.StatusCode != 200 {
-		log.Default().Printf("Failed to fetch data, StatusCode: %s", res.Status)
-		return nil
+	if !synonymID.Valid {
+		return "", errors.New("no id found")
 	}
+	return synonymID.String, nil
+}
 
-	return body
+// UpdateLastFetchStatus updates the last fetch status for a taxon
+// this function should only be called if GBIF answered with ErrNotFound, successful fetches update it in SaveTaxonObservations
+// The LastFetch column is used to determine if a taxon is due for a refresh, see NextRefreshBatch
+func UpdateLastFetchStatus(ctx context.Context, db *sql.DB, taxonID string) bool {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.ExecContext(ctx, updateLastFetchQuery, now, taxonID, taxonID)
+	if err != nil {
+		slog.Error("Failed to update last fetch status", "error", err)
+		return false
+	}
+	return true
 }
 
 // Helper function to get the years of observations via facet from the API
-func getYears(taxonID string) []int {
+func (c *Client) getYears(ctx context.Context, taxonID string) ([]int, error) {
 	var years []int
 
 	year := time.Now().Year() + 1
 	url := endpoint + "?facetMultiselect=true&facet=year&facetLimit=5000&taxonKey=" + taxonID + "&year=" + fmt.Sprint(year)
 
-	body := internalFetch(url)
-	if body == nil {
-		log.Default().Print("Failed to fetch years data")
-		return years
+	body, err := c.fetch(ctx, url)
+	if err != nil {
+		return nil, err
 	}
 	var response Response
-	json.Unmarshal(body, &response)
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, invalidBody(url, err)
+	}
 	if len(response.Facets) > 0 {
 		for _, facet := range response.Facets {
 			if facet.Field == "YEAR" {
@@ -299,11 +378,11 @@ func getYears(taxonID string) []int {
 	sort.Slice(years, func(a, b int) bool {
 		return years[b] < years[a]
 	})
-	return years
+	return years, nil
 }
 
 // Helper function to get the countries of observations via facet from the API
-func getCountries(taxonID string, years []int) map[string]string {
+func (c *Client) getCountries(ctx context.Context, taxonID string, years []int) (map[string]string, error) {
 	countriesMap := make(map[string]string)
 
 	countries := make(map[string]string)
@@ -316,9 +395,15 @@ func getCountries(taxonID string, years []int) map[string]string {
 		}
 
 		url := endpoint + "?facet=country&facetLimit=5000&taxonKey=" + taxonID + "&year=" + fmt.Sprint(year)
-		body := internalFetch(url)
+		body, err := c.fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
 		var response Response
-		json.Unmarshal(body, &response)
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return nil, invalidBody(url, err)
+		}
 
 		if len(response.Facets) > 0 {
 			for _, facet := range response.Facets {
@@ -337,7 +422,7 @@ func getCountries(taxonID string, years []int) map[string]string {
 		}
 	}
 
-	return countriesMap
+	return countriesMap, nil
 }
 
 // Clean observation date to be in the format of YYYY-MM-DD
@@ -367,16 +452,26 @@ func CleanDate(date string) string {
 	}
 }
 
-// We are only interested in the latest observation for each taxon, so we clear the old ones before inserting new ones
-// runs in the same transaction as SaveObservation
-func clearOldObservations(db *sql.DB, taxonID string) {
-	res, err := db.Exec("DELETE FROM observations WHERE TaxonID = ?", taxonID)
+// We are only interested in the latest observation for each taxon, so we clear the old ones before inserting new ones.
+// Observations which are part of the new set are kept and replaced by the insert, DuckDB does not allow
+// deleting and inserting the same primary key in one transaction.
+func clearOldObservations(ctx context.Context, tx *sql.Tx, taxonID string, observations []LatestObservation) error {
+	query := "DELETE FROM observations WHERE TaxonID = ?"
+	args := []any{taxonID}
+	if len(observations) > 0 {
+		query += " AND ObservationID NOT IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(observations)), ", ") + ")"
+		for _, obs := range observations {
+			args = append(args, obs.ObservationID)
+		}
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		slog.Error("Database error on clearing old observations", err)
+		return err
 	}
 	affected, err := res.RowsAffected()
 	if err != nil {
-		slog.Error("Failed to get affected rows", err)
+		slog.Error("Failed to get affected rows", "error", err)
 	}
 	slog.Info("Deleted old observations", "taxonID", taxonID, "affected", affected)
+	return nil
 }
@@ -1,13 +1,23 @@
 package gbif
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif/gbiftest"
 )
 
 // Demo data for testing, it is no synonym
@@ -20,30 +30,356 @@ var DemoSyn = []string{
 	"8071112", "4492208", "'Urocerus gigas'", "'Ichneumon gigas'", "'Animalia'", "'Arthropoda'", "'Insecta'", "'Hymenoptera'", "'Siricidae'", "'Urocerus'", "true",
 }
 
-func TestUpdateConfig(t *testing.T) {
-	UpdateConfig(Config{UserAgentPrefix: "test"})
-}
-
 func TestFetchLatest(t *testing.T) {
-	loadDemo()
-	/* Endemic species to Austria, fast response low number of results */
-	/* https://www.gbif.org/species/4560445 */
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: "4560445", Country: "AT", EventDate: "2019-05-01"},
+		gbiftest.Occurrence{Key: 2, TaxonKey: "4560445", Country: "AT", EventDate: "2021-06-03T10:00:00"},
+		gbiftest.Occurrence{Key: 3, TaxonKey: "4560445", Country: "AT", EventDate: "2021-08-10/2021-08-12"},
+		gbiftest.Occurrence{Key: 4, TaxonKey: "4560445", Country: "DE", EventDate: "2015"},
+		gbiftest.Occurrence{Key: 5, TaxonKey: "1", Country: "IT", EventDate: "2022-01-01"},
+	)
+	defer server.Close()
+
 	var id = "4560445"
-	res := FetchLatest(id)
-	if res == nil {
-		t.Errorf("got %v, wanted %v", res, "not nil")
+	client := newTestClient(server.URL)
+	res, err := client.FetchLatest(context.Background(), id)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	want := []LatestObservation{
+		{ObservationID: "3", ObservationOriginalDate: "2021-08-10/2021-08-12", ObservationDate: "2021-08-10", CountryCode: "AT", TaxonID: id},
+		{ObservationID: "4", ObservationOriginalDate: "2015", ObservationDate: "2015-01-01", CountryCode: "DE", TaxonID: id},
 	}
-	if len(*res) == 0 {
-		t.Errorf("got %d, wanted < %d", len(*res), 1)
+	if len(*res) != len(want) {
+		t.Fatalf("got %d, wanted %d", len(*res), len(want))
 	}
-	if (*res)[0].TaxonID != id {
-		t.Errorf("got %s, wanted %s", (*res)[0].TaxonID, id)
+	for i := range want {
+		if (*res)[i] != want[i] {
+			t.Errorf("got %v, wanted %v", (*res)[i], want[i])
+		}
 	}
 
-	res = FetchLatest("123456")
+	res, err = client.FetchLatest(context.Background(), "123456")
 	if res != nil {
 		t.Errorf("got %v, wanted %v", res, nil)
 	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, wanted %v", err, ErrNotFound)
+	}
+}
+
+func TestFetchLatestPaging(t *testing.T) {
+	server := gbiftest.NewServer()
+	defer server.Close()
+	for i := 1; i <= 650; i++ {
+		server.Add(gbiftest.Occurrence{Key: i, TaxonKey: "1", Country: "AT", EventDate: fmt.Sprintf("2020-%02d-%02d", i%12+1, i%28+1)})
+	}
+	server.Add(gbiftest.Occurrence{Key: 651, TaxonKey: "1", Country: "AT", EventDate: "2020-12-30"})
+
+	res, err := newTestClient(server.URL).FetchLatest(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(*res) != 1 || (*res)[0].ObservationID != "651" {
+		t.Errorf("got %v, wanted %v", *res, "observation 651")
+	}
+	/* Years, countries and three pages of 300 */
+	if server.Requests() != 5 {
+		t.Errorf("got %d, wanted %d", server.Requests(), 5)
+	}
+}
+
+func TestFetchLatestUpstreamError(t *testing.T) {
+	server := gbiftest.NewServer(gbiftest.Occurrence{Key: 1, TaxonKey: "1", Country: "AT", EventDate: "2020-01-01"})
+	defer server.Close()
+	server.Fail(gbiftest.Failure{Status: http.StatusBadGateway, Times: 10})
+
+	res, err := newTestClient(server.URL).FetchLatest(context.Background(), "1")
+	if res != nil {
+		t.Errorf("got %v, wanted %v", res, nil)
+	}
+	if !errors.Is(err, ErrUpstream) {
+		t.Errorf("got %v, wanted %v", err, ErrUpstream)
+	}
+}
+
+func TestGetYears(t *testing.T) {
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: "1", Country: "AT", EventDate: "1990-01-01"},
+		gbiftest.Occurrence{Key: 2, TaxonKey: "1", Country: "AT", EventDate: "2020-01-01"},
+		gbiftest.Occurrence{Key: 3, TaxonKey: "1", Country: "DE", EventDate: "2020-05-01"},
+		gbiftest.Occurrence{Key: 4, TaxonKey: "2", Country: "DE", EventDate: "2021-05-01"},
+	)
+	defer server.Close()
+
+	years, err := newTestClient(server.URL).getYears(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(years) != 2 || years[0] != 2020 || years[1] != 1990 {
+		t.Errorf("got %v, wanted %v", years, []int{2020, 1990})
+	}
+}
+
+func TestGetCountries(t *testing.T) {
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: "1", Country: "AT", EventDate: "1990-01-01"},
+		gbiftest.Occurrence{Key: 2, TaxonKey: "1", Country: "AT", EventDate: "2020-01-01"},
+		gbiftest.Occurrence{Key: 3, TaxonKey: "1", Country: "DE", EventDate: "1990-05-01"},
+	)
+	defer server.Close()
+
+	countries, err := newTestClient(server.URL).getCountries(context.Background(), "1", []int{2020, 1990})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(countries) != 2 || countries["AT"] != "2020" || countries["DE"] != "1990" {
+		t.Errorf("got %v, wanted %v", countries, map[string]string{"AT": "2020", "DE": "1990"})
+	}
+}
+
+func TestRefreshTaxa(t *testing.T) {
+	loadDemo()
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: DemoTaxa[0], Country: "AT", EventDate: "2001-03-04"},
+		gbiftest.Occurrence{Key: 2, TaxonKey: DemoTaxa[0], Country: "DE", EventDate: "1999-01-01"},
+	)
+	defer server.Close()
+
+	/* GBIF is down, the taxon should be retried on the next run */
+	server.Fail(gbiftest.Failure{Status: http.StatusServiceUnavailable, Times: 3})
+	result, err := newTestClient(server.URL).RefreshTaxa(context.Background(), internal.DB, TriggerCLI, []string{DemoTaxa[0]})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !errors.Is(result.Failed[DemoTaxa[0]], ErrUpstream) || !errors.Is(result.Err(), ErrUpstream) {
+		t.Errorf("got %v, wanted %v", result.Failed, ErrUpstream)
+	}
+	var lastFetch sql.NullTime
+	err = internal.DB.QueryRow("SELECT LastFetch FROM taxa WHERE TaxonID = ?", DemoTaxa[0]).Scan(&lastFetch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if lastFetch.Valid {
+		t.Errorf("got %v, wanted %v", lastFetch.Valid, false)
+	}
+
+	result, err = newTestClient(server.URL).RefreshTaxa(context.Background(), internal.DB, TriggerCLI, []string{DemoTaxa[0]})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if result.Attempted != 1 || result.Updated != 1 || result.Err() != nil {
+		t.Errorf("got %v, wanted %v", result, "one updated taxon")
+	}
+	var count int
+	err = internal.DB.QueryRow("SELECT COUNT(*) FROM observations WHERE TaxonID = ?", DemoTaxa[0]).Scan(&count)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("got %d, wanted %d", count, 2)
+	}
+	err = internal.DB.QueryRow("SELECT LastFetch FROM taxa WHERE TaxonID = ?", DemoTaxa[0]).Scan(&lastFetch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !lastFetch.Valid {
+		t.Errorf("got %v, wanted %v", lastFetch.Valid, true)
+	}
+
+	/* Rate limits stop the batch */
+	server.Fail(gbiftest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "0", Times: 3})
+	_, err = newTestClient(server.URL).RefreshTaxa(context.Background(), internal.DB, TriggerCLI, []string{DemoTaxa[0]})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v, wanted %v", err, ErrRateLimited)
+	}
+}
+
+func TestRefreshRuns(t *testing.T) {
+	loadDemo()
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: DemoTaxa[0], Country: "AT", EventDate: "2001-03-04"},
+	)
+	defer server.Close()
+
+	server.Fail(gbiftest.Failure{Status: http.StatusServiceUnavailable, Times: 3})
+	_, err := newTestClient(server.URL).RefreshTaxa(context.Background(), internal.DB, TriggerCron, []string{DemoTaxa[0]})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	_, err = newTestClient(server.URL).RefreshTaxa(context.Background(), internal.DB, TriggerManual, []string{DemoTaxa[0]})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	rows, err := internal.DB.Query(`SELECT TriggeredBy, FinishedAt IS NOT NULL, Attempted, Succeeded, Failed, ErrorType, StatusCode, Requests, Countries
+		FROM fetch_runs INNER JOIN fetch_attempts USING (RunID) ORDER BY RunID`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	type run struct {
+		trigger                      string
+		finished                     bool
+		attempted, succeeded, failed int
+		errorType                    sql.NullString
+		statusCode                   sql.NullInt64
+		requests, countries          int
+	}
+	var runs []run
+	for rows.Next() {
+		var r run
+		if err := rows.Scan(&r.trigger, &r.finished, &r.attempted, &r.succeeded, &r.failed, &r.errorType, &r.statusCode, &r.requests, &r.countries); err != nil {
+			log.Fatal(err)
+		}
+		runs = append(runs, r)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("got %d, wanted %d", len(runs), 2)
+	}
+
+	failed := runs[0]
+	if failed.trigger != TriggerCron || !failed.finished || failed.attempted != 1 || failed.failed != 1 {
+		t.Errorf("got %v, wanted a finished cron run with one failed taxon", failed)
+	}
+	if failed.errorType.String != ErrorTypeUpstream || failed.statusCode.Int64 != http.StatusServiceUnavailable || failed.requests != 3 {
+		t.Errorf("got %v, wanted %s with status %d after 3 requests", failed, ErrorTypeUpstream, http.StatusServiceUnavailable)
+	}
+
+	succeeded := runs[1]
+	if succeeded.trigger != TriggerManual || succeeded.succeeded != 1 || succeeded.errorType.Valid {
+		t.Errorf("got %v, wanted a manual run with one updated taxon", succeeded)
+	}
+	if succeeded.requests == 0 || succeeded.countries != 1 {
+		t.Errorf("got %v, wanted requests and %d country", succeeded, 1)
+	}
+}
+
+func TestFetchJobs(t *testing.T) {
+	loadDemo()
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: DemoTaxa[0], Country: "AT", EventDate: "2001-03-04"},
+		gbiftest.Occurrence{Key: 2, TaxonKey: DemoTaxa[0], Country: "DE", EventDate: "1999-01-01"},
+	)
+	defer server.Close()
+	client := newTestClient(server.URL)
+	client.BackoffMax = time.Second
+	jobs := NewFetchJobs(context.Background(), client, internal.DB)
+	ctx := context.Background()
+
+	/* The retry after the rate limit keeps the job running, a second fetch of the taxon joins it */
+	server.Fail(gbiftest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "1"})
+	job, err := jobs.Start(ctx, DemoTaxa[0])
+	if err != nil || job.Status != JobRunning {
+		t.Fatalf("got %s %v, wanted %s", job.Status, err, JobRunning)
+	}
+	if again, err := jobs.Start(ctx, DemoTaxa[0]); err != nil || again.ID != job.ID {
+		t.Errorf("got %s %v, wanted %s", again.ID, err, job.ID)
+	}
+	MaxFetchJobs = 1
+	defer func() { MaxFetchJobs = DefaultMaxFetchJobs }()
+	if _, err := jobs.Start(ctx, DemoSyn[0]); !errors.Is(err, ErrTooManyFetches) {
+		t.Errorf("got %v, wanted %v", err, ErrTooManyFetches)
+	}
+
+	job = waitForJob(t, jobs, job.ID)
+	if job.Status != JobDone || job.FinishedAt == nil {
+		t.Fatalf("got %+v, wanted %s", job, JobDone)
+	}
+	if job.Progress.Years != 2 || job.Progress.Countries != 2 || job.Progress.Pages["AT"] != 1 || job.Progress.Pages["DE"] != 1 {
+		t.Errorf("got %+v, wanted 2 years, 2 countries and one page each", job.Progress)
+	}
+
+	/* The taxon was just fetched */
+	if _, err := jobs.Start(ctx, DemoTaxa[0]); !errors.Is(err, ErrFetchCooldown) {
+		t.Errorf("got %v, wanted %v", err, ErrFetchCooldown)
+	}
+
+	job, err = jobs.Start(ctx, "1")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	job = waitForJob(t, jobs, job.ID)
+	if job.Status != JobFailed || job.ErrorType != ErrorTypeNotFound {
+		t.Errorf("got %+v, wanted %s", job, ErrorTypeNotFound)
+	}
+	if _, _, ok := jobs.Get("unknown"); ok {
+		t.Errorf("got %v, wanted %v", ok, false)
+	}
+}
+
+func TestFetchJobsCooldownRace(t *testing.T) {
+	loadDemo()
+	server := gbiftest.NewServer(gbiftest.Occurrence{Key: 1, TaxonKey: DemoTaxa[0], Country: "AT", EventDate: "2001-03-04"})
+	defer server.Close()
+	jobs := NewFetchJobs(context.Background(), newTestClient(server.URL), internal.DB)
+	ctx := context.Background()
+
+	/* Starts while the job finishes join it or hit the cooldown, they never start a second fetch */
+	job, err := jobs.Start(ctx, DemoTaxa[0])
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	var mu sync.Mutex
+	ids := map[string]bool{job.ID: true}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				started, err := jobs.Start(ctx, DemoTaxa[0])
+				if errors.Is(err, ErrFetchCooldown) {
+					return
+				}
+				if err != nil {
+					t.Errorf("got %v, wanted %v", err, ErrFetchCooldown)
+					return
+				}
+				mu.Lock()
+				ids[started.ID] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ids) != 1 {
+		t.Errorf("got %d jobs, wanted %d", len(ids), 1)
+	}
+}
+
+// Helper to follow the changes of a job until it finished
+func waitForJob(t *testing.T, jobs *FetchJobs, id string) FetchJob {
+	timeout := time.After(10 * time.Second)
+	for {
+		job, changed, ok := jobs.Get(id)
+		if !ok {
+			t.Fatalf("got %v, wanted job %s", ok, id)
+		}
+		if job.Finished() {
+			return job
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("got %+v, wanted finished job", job)
+		}
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	for err, want := range map[error]string{
+		nil:                                   "",
+		ErrNotFound:                           ErrorTypeNotFound,
+		&RequestError{Err: ErrRateLimited}:    ErrorTypeRateLimited,
+		fmt.Errorf("%w: %w", ErrSave, io.EOF): ErrorTypeSave,
+		context.DeadlineExceeded:              ErrorTypeCanceled,
+		io.EOF:                                ErrorTypeOther,
+	} {
+		if got := ErrorType(err); got != want {
+			t.Errorf("got %s, wanted %s", got, want)
+		}
+	}
 }
 
 func TestSaveObservations(t *testing.T) {
@@ -59,10 +395,147 @@ func TestSaveObservations(t *testing.T) {
 	var observations = &[][]LatestObservation{}
 	*observations = append(*observations, []LatestObservation{observation})
 
-	SaveObservation(observations, internal.DB)
+	err := SaveObservation(context.Background(), observations, internal.DB)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	var count int
+	err = internal.DB.QueryRow("SELECT COUNT(*) FROM observations WHERE TaxonID = ?", DemoTaxa[0]).Scan(&count)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d, wanted %d", count, 1)
+	}
+}
+
+func TestSaveTaxonObservations(t *testing.T) {
+	loadDemo()
+	ctx := context.Background()
+	old := []LatestObservation{
+		{TaxonID: DemoTaxa[0], ObservationID: "1", ObservationOriginalDate: "1989-01-05", ObservationDate: "1989-01-05", CountryCode: "AT"},
+		{TaxonID: DemoTaxa[0], ObservationID: "2", ObservationOriginalDate: "1990", ObservationDate: "1990-01-01", CountryCode: "DE"},
+	}
+	err := SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], old)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	_, err = internal.DB.Exec("DELETE FROM observation_history")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	/* Same observation id again and a new one, the old DE observation is replaced */
+	updated := []LatestObservation{
+		{TaxonID: DemoTaxa[0], ObservationID: "1", ObservationOriginalDate: "1989-01-05", ObservationDate: "1989-01-05", CountryCode: "AT"},
+		{TaxonID: DemoTaxa[0], ObservationID: "3", ObservationOriginalDate: "2001", ObservationDate: "2001-01-01", CountryCode: "DE"},
+	}
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], updated)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	var ids string
+	err = internal.DB.QueryRow("SELECT string_agg(ObservationID::VARCHAR, ',' ORDER BY ObservationID) FROM observations WHERE TaxonID = ?", DemoTaxa[0]).Scan(&ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ids != "1,3" {
+		t.Errorf("got %s, wanted %s", ids, "1,3")
+	}
+
+	/* Only the changed DE observation is added to the history */
+	var history string
+	err = internal.DB.QueryRow("SELECT string_agg(CountryCode || ':' || PreviousObservationID || '>' || ObservationID, ',') FROM observation_history WHERE TaxonID = ?", DemoTaxa[0]).Scan(&history)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if history != "DE:2>3" {
+		t.Errorf("got %s, wanted %s", history, "DE:2>3")
+	}
+
+	/* A vanished country is recorded without a new observation */
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], updated[:1])
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	var vanished int
+	err = internal.DB.QueryRow("SELECT COUNT(*) FROM observation_history WHERE TaxonID = ? AND CountryCode = 'DE' AND PreviousObservationID = 3 AND ObservationID IS NULL", DemoTaxa[0]).Scan(&vanished)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if vanished != 1 {
+		t.Errorf("got %d, wanted %d", vanished, 1)
+	}
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], updated)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+
+	/* A failing insert keeps the old observations */
+	broken := []LatestObservation{
+		{TaxonID: DemoTaxa[0], ObservationID: "4", ObservationOriginalDate: "bad", ObservationDate: "not-a-date", CountryCode: "AT"},
+	}
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], broken)
+	if err == nil {
+		t.Errorf("got %v, wanted %v", err, "error")
+	}
+	err = internal.DB.QueryRow("SELECT string_agg(ObservationID::VARCHAR, ',' ORDER BY ObservationID) FROM observations WHERE TaxonID = ?", DemoTaxa[0]).Scan(&ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ids != "1,3" {
+		t.Errorf("got %s, wanted %s", ids, "1,3")
+	}
+}
+
+func TestRediscoveries(t *testing.T) {
+	loadDemo()
+	ctx := context.Background()
+	_, err := internal.DB.Exec("DELETE FROM rediscoveries")
+	if err != nil {
+		log.Fatal(err)
+	}
+	old := []LatestObservation{
+		{TaxonID: DemoTaxa[0], ObservationID: "10", ObservationOriginalDate: "1900", ObservationDate: "1900-01-01", CountryCode: "AT"},
+		{TaxonID: DemoTaxa[0], ObservationID: "11", ObservationOriginalDate: "1990", ObservationDate: "1990-01-01", CountryCode: "DE"},
+	}
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], old)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+
+	/* AT moved forward by 100 years, DE only by 20 */
+	updated := []LatestObservation{
+		{TaxonID: DemoTaxa[0], ObservationID: "12", ObservationOriginalDate: "2000", ObservationDate: "2000-01-01", CountryCode: "AT"},
+		{TaxonID: DemoTaxa[0], ObservationID: "13", ObservationOriginalDate: "2010", ObservationDate: "2010-01-01", CountryCode: "DE"},
+	}
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], updated)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+
+	var country string
+	var previousID, newID string
+	var gap float64
+	err = internal.DB.QueryRow("SELECT CountryCode, PreviousObservationID::VARCHAR, ObservationID::VARCHAR, GapYears FROM rediscoveries WHERE TaxonID = ?", DemoTaxa[0]).Scan(&country, &previousID, &newID, &gap)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if country != "AT" || previousID != "10" || newID != "12" {
+		t.Errorf("got %s %s>%s, wanted %s", country, previousID, newID, "AT 10>12")
+	}
+	if gap < 99.9 || gap > 100.1 {
+		t.Errorf("got %f, wanted %d", gap, 100)
+	}
 
+	/* Same data again finds nothing new */
+	err = SaveTaxonObservations(ctx, internal.DB, DemoTaxa[0], updated)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
 	var count int
-	err := internal.DB.QueryRow("SELECT COUNT(*) FROM observations WHERE TaxonID = ?", DemoTaxa[0]).Scan(&count)
+	err = internal.DB.QueryRow("SELECT COUNT(*) FROM rediscoveries WHERE TaxonID = ?", DemoTaxa[0]).Scan(&count)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -71,14 +544,145 @@ func TestSaveObservations(t *testing.T) {
 	}
 }
 
-func TestGetOutdatedObservations(t *testing.T) {
+func TestNextRefreshBatch(t *testing.T) {
 	loadDemo()
-	want := GetOutdatedObservations(internal.DB)
-	if len(want) != 1 {
-		t.Errorf("got %d, wanted %d", len(want), 1)
+	ctx := context.Background()
+	/* Second accepted taxon, fetched seven months ago with many observations and page views */
+	_, err := internal.DB.Exec(`INSERT OR REPLACE INTO taxa (TaxonID, SynonymID, ScientificName, LastFetch) VALUES (1, 1, 'Apis mellifera', ?)`, time.Now().UTC().AddDate(0, -7, 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = internal.DB.Exec(`INSERT INTO observations (TaxonID, ObservationID, ObservationDateOriginal, ObservationDate, CountryCode) VALUES
+		(1, 11, '2020', '2020-01-01', 'AT'), (1, 12, '2020', '2020-01-01', 'DE')`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for range 3 {
+		if err = RecordDemand(ctx, internal.DB, "1"); err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
 	}
-	if want[0] != DemoTaxa[0] {
-		t.Errorf("got %s, wanted %s", want[0], DemoTaxa[0])
+	/* Synonyms count for the accepted taxon */
+	if err = RecordDemand(ctx, internal.DB, DemoSyn[0]); err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+
+	/* Never fetched comes first, the synonym itself is never queued */
+	ids, err := NextRefreshBatch(ctx, internal.DB, 10, 6)
+	if err != nil || !slices.Equal(ids, []string{DemoTaxa[0], "1"}) {
+		t.Errorf("got %v %v, wanted %v", ids, err, []string{DemoTaxa[0], "1"})
+	}
+	var demand int
+	var priority float64
+	err = internal.DB.QueryRow("SELECT Demand, Priority FROM refresh_queue WHERE TaxonID = 1").Scan(&demand, &priority)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if demand != 3 || priority <= 7000 || priority >= 8000 {
+		t.Errorf("got %d %f, wanted %d and 7000 < priority < 8000", demand, priority, 3)
+	}
+
+	ids, _ = NextRefreshBatch(ctx, internal.DB, 1, 6)
+	if len(ids) != 1 || ids[0] != DemoTaxa[0] {
+		t.Errorf("got %v, wanted %v", ids, DemoTaxa[0])
+	}
+	/* With a longer window only the never fetched taxon is due */
+	ids, _ = NextRefreshBatch(ctx, internal.DB, 10, 12)
+	if len(ids) != 1 || ids[0] != DemoTaxa[0] {
+		t.Errorf("got %v, wanted %v", ids, DemoTaxa[0])
+	}
+}
+
+func TestRecordDemand(t *testing.T) {
+	loadDemo()
+	ctx := context.Background()
+	demand := func(taxonID string) int {
+		var count int
+		err := internal.DB.QueryRow("SELECT COALESCE(MAX(Demand), 0) FROM refresh_queue WHERE TaxonID = ?", taxonID).Scan(&count)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return count
+	}
+
+	/* Taxa fetched within the stale window are not queued */
+	_, err := internal.DB.Exec(`INSERT OR REPLACE INTO taxa (TaxonID, SynonymID, ScientificName, LastFetch) VALUES (1, 1, 'Apis mellifera', ?)`, time.Now().UTC())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = RecordDemand(ctx, internal.DB, "1"); err != nil || demand("1") != 0 {
+		t.Errorf("got %d %v, wanted %d", demand("1"), err, 0)
+	}
+
+	/* Demand is capped */
+	for range 120 {
+		if err = RecordDemand(ctx, internal.DB, DemoTaxa[0]); err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+	}
+	if demand(DemoTaxa[0]) != 99 {
+		t.Errorf("got %d, wanted %d", demand(DemoTaxa[0]), 99)
+	}
+
+	/* A client counts once per taxon, the synonym counts for the accepted taxon */
+	_, err = internal.DB.Exec("DELETE FROM refresh_queue")
+	if err != nil {
+		log.Fatal(err)
+	}
+	recorder := NewDemandRecorder()
+	for _, client := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		if err = recorder.Record(ctx, internal.DB, DemoTaxa[0], client); err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+	}
+	if err = recorder.Record(ctx, internal.DB, DemoSyn[0], "192.0.2.1"); err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if demand(DemoTaxa[0]) != 3 {
+		t.Errorf("got %d, wanted %d", demand(DemoTaxa[0]), 3)
+	}
+}
+
+func TestDrainRefreshQueue(t *testing.T) {
+	loadDemo()
+	ctx := context.Background()
+	server := gbiftest.NewServer(
+		gbiftest.Occurrence{Key: 1, TaxonKey: DemoTaxa[0], Country: "AT", EventDate: "2001-03-04"},
+	)
+	defer server.Close()
+
+	/* Failed taxa stay in the queue and back off */
+	server.Fail(gbiftest.Failure{Status: http.StatusServiceUnavailable, Times: 3})
+	result, err := newTestClient(server.URL).DrainRefreshQueue(ctx, internal.DB, TriggerCron)
+	if err != nil || len(result.Failed) != 1 {
+		t.Errorf("got %v %v, wanted one failed taxon", result, err)
+	}
+	var attempts int
+	err = internal.DB.QueryRow("SELECT Attempts FROM refresh_queue WHERE TaxonID = ?", DemoTaxa[0]).Scan(&attempts)
+	if err != nil || attempts != 1 {
+		t.Errorf("got %d %v, wanted %d", attempts, err, 1)
+	}
+	ids, _ := NextRefreshBatch(ctx, internal.DB, 10, 6)
+	if len(ids) != 0 {
+		t.Errorf("got %v, wanted %v", ids, []string{})
+	}
+
+	/* Refreshed taxa leave the queue */
+	_, err = internal.DB.Exec("UPDATE refresh_queue SET LastAttempt = ?", time.Now().UTC().Add(-2*time.Hour))
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err = newTestClient(server.URL).DrainRefreshQueue(ctx, internal.DB, TriggerCron)
+	if err != nil || result.Updated != 1 {
+		t.Errorf("got %v %v, wanted one updated taxon", result, err)
+	}
+	if length := GetRefreshQueueLength(ctx, internal.DB); length != 0 {
+		t.Errorf("got %d, wanted %d", length, 0)
+	}
+	var count int
+	err = internal.DB.QueryRow("SELECT COUNT(*) FROM refresh_queue").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("got %d %v, wanted %d", count, err, 0)
 	}
 }
 
@@ -96,7 +700,7 @@ func TestUpdateLastFetchStatus(t *testing.T) {
 	}
 
 	/* Update last fetch status and it should return one */
-	UpdateLastFetchStatus(internal.DB, DemoTaxa[0])
+	UpdateLastFetchStatus(context.Background(), internal.DB, DemoTaxa[0])
 
 	err = internal.DB.QueryRow("SELECT LastFetch FROM taxa WHERE TaxonID = ?", DemoTaxa[0]).Scan(&lastFetch)
 	if err != nil {
@@ -114,7 +718,7 @@ func TestGetSynonymID(t *testing.T) {
 	loadDemo()
 
 	/* Actual synonym */
-	want, err := GetSynonymID(internal.DB, DemoSyn[0])
+	want, err := GetSynonymID(context.Background(), internal.DB, DemoSyn[0])
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
@@ -123,7 +727,7 @@ func TestGetSynonymID(t *testing.T) {
 	}
 
 	/* If no synonym return itself */
-	want, err = GetSynonymID(internal.DB, DemoTaxa[0])
+	want, err = GetSynonymID(context.Background(), internal.DB, DemoTaxa[0])
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
@@ -132,7 +736,7 @@ func TestGetSynonymID(t *testing.T) {
 	}
 
 	/* If no taxon in database return error */
-	_, err = GetSynonymID(internal.DB, "123456")
+	_, err = GetSynonymID(context.Background(), internal.DB, "123456")
 	if err == nil {
 		t.Errorf("got %v, wanted %v", err, "error")
 	}
@@ -142,14 +746,16 @@ func TestGetSynonymID(t *testing.T) {
 func loadDemo() {
 	slog.SetLogLoggerLevel(slog.LevelError)
 	internal.Load()
-	internal.Migrations(internal.DB, internal.Config.ROOT)
+	if err := internal.Migrations(internal.DB, migrations.FS); err != nil {
+		log.Fatal(err)
+	}
 
 	_, err := internal.DB.Exec(`
 		INSERT OR REPLACE INTO taxa
 		(TaxonID, SynonymID, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus)
 		VALUES (` + strings.Join(DemoTaxa, ",") + ")")
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Database error", "error", err)
 		log.Fatal(err)
 	}
 	_, err = internal.DB.Exec(`
@@ -157,7 +763,7 @@ func loadDemo() {
 		(TaxonID, SynonymID, SynonymName, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus, isSynonym)
 		VALUES  (` + strings.Join(DemoSyn, ",") + ")")
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Database error", "error", err)
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,247 @@
+// Purpose: Fake GBIF occurrence API for offline tests, serves /occurrence/search from fixture data
+package gbiftest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 300
+)
+
+// Occurrence is a single fixture record, only the fields used by gbif-extinct are modelled.
+// If Year is not set it is taken from the EventDate.
+type Occurrence struct {
+	Key        int
+	TaxonKey   string
+	Country    string
+	Year       int
+	EventDate  string
+	DatasetKey string
+}
+
+// Failure is an injected error response, it is served Times times before the server answers normally again
+type Failure struct {
+	Status     int
+	RetryAfter string
+	Body       string
+	Times      int
+}
+
+// Server is a fake GBIF API. Use URL as BaseURL for the gbif client.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	occurrences []Occurrence
+	failures    []Failure
+	requests    atomic.Int64
+}
+
+type response struct {
+	Offset       int          `json:"offset"`
+	Limit        int          `json:"limit"`
+	EndOfRecords bool         `json:"endOfRecords"`
+	Count        int          `json:"count"`
+	Results      []result     `json:"results"`
+	Facets       []facetField `json:"facets"`
+}
+
+type result struct {
+	Key        int    `json:"key"`
+	DatasetKey string `json:"datasetKey"`
+	EventDate  string `json:"eventDate"`
+}
+
+type facetField struct {
+	Field  string       `json:"field"`
+	Counts []facetCount `json:"counts"`
+}
+
+type facetCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NewServer starts a fake GBIF API serving the given occurrences, the caller must call Close
+func NewServer(occurrences ...Occurrence) *Server {
+	s := &Server{}
+	s.Add(occurrences...)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Add fixture occurrences to the server
+func (s *Server) Add(occurrences ...Occurrence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range occurrences {
+		if o.Year == 0 && len(o.EventDate) >= 4 {
+			o.Year, _ = strconv.Atoi(o.EventDate[:4])
+		}
+		s.occurrences = append(s.occurrences, o)
+	}
+}
+
+// Fail queues an error response, failures are served in the order they were added
+func (s *Server) Fail(failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failure.Times == 0 {
+		failure.Times = 1
+	}
+	s.failures = append(s.failures, failure)
+}
+
+// Requests returns the number of requests the server received, including failed ones
+func (s *Server) Requests() int {
+	return int(s.requests.Load())
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+
+	if failure, ok := s.nextFailure(); ok {
+		if failure.RetryAfter != "" {
+			w.Header().Set("Retry-After", failure.RetryAfter)
+		}
+		status := failure.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(failure.Body))
+		return
+	}
+
+	if r.URL.Path != "/occurrence/search" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit := defaultLimit
+	if query.Has("limit") {
+		limit, _ = strconv.Atoi(query.Get("limit"))
+	}
+	limit = min(max(limit, 0), maxLimit)
+
+	s.mu.Lock()
+	matches := filter(s.occurrences, query, "")
+	facets := buildFacets(s.occurrences, query)
+	s.mu.Unlock()
+
+	res := response{
+		Offset:  offset,
+		Limit:   limit,
+		Count:   len(matches),
+		Results: []result{},
+		Facets:  facets,
+	}
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		res.Results = append(res.Results, result{Key: matches[i].Key, DatasetKey: matches[i].DatasetKey, EventDate: matches[i].EventDate})
+	}
+	res.EndOfRecords = offset+limit >= len(matches)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) nextFailure() (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures) == 0 {
+		return Failure{}, false
+	}
+	failure := s.failures[0]
+	s.failures[0].Times--
+	if s.failures[0].Times <= 0 {
+		s.failures = s.failures[1:]
+	}
+	return failure, true
+}
+
+// Helper to filter occurrences by the query parameters, the skip parameter is ignored which GBIF does for facetMultiselect
+func filter(occurrences []Occurrence, query map[string][]string, skip string) []Occurrence {
+	var matches []Occurrence
+	for _, o := range occurrences {
+		if !matchParam(query, "taxonKey", skip, o.TaxonKey) {
+			continue
+		}
+		if !matchParam(query, "country", skip, o.Country) {
+			continue
+		}
+		if !matchParam(query, "year", skip, strconv.Itoa(o.Year)) {
+			continue
+		}
+		matches = append(matches, o)
+	}
+	slices.SortStableFunc(matches, func(a, b Occurrence) int {
+		return a.Key - b.Key
+	})
+	return matches
+}
+
+func matchParam(query map[string][]string, param string, skip string, value string) bool {
+	if param == skip {
+		return true
+	}
+	values, ok := query[param]
+	if !ok || len(values) == 0 {
+		return true
+	}
+	return slices.Contains(values, value)
+}
+
+func buildFacets(occurrences []Occurrence, query map[string][]string) []facetField {
+	var facets []facetField
+	multiselect := query["facetMultiselect"] != nil && query["facetMultiselect"][0] == "true"
+	for _, field := range query["facet"] {
+		var param string
+		var value func(o Occurrence) string
+		switch field {
+		case "year":
+			param = "year"
+			value = func(o Occurrence) string { return strconv.Itoa(o.Year) }
+		case "country":
+			param = "country"
+			value = func(o Occurrence) string { return o.Country }
+		default:
+			continue
+		}
+
+		skip := ""
+		if multiselect {
+			skip = param
+		}
+		counts := map[string]int{}
+		for _, o := range filter(occurrences, query, skip) {
+			counts[value(o)]++
+		}
+
+		facet := facetField{Field: strings.ToUpper(field), Counts: []facetCount{}}
+		for name, count := range counts {
+			facet.Counts = append(facet.Counts, facetCount{Name: name, Count: count})
+		}
+		slices.SortFunc(facet.Counts, func(a, b facetCount) int {
+			if a.Count != b.Count {
+				return b.Count - a.Count
+			}
+			if a.Name < b.Name {
+				return -1
+			}
+			return 1
+		})
+		facets = append(facets, facet)
+	}
+	return facets
+}
@@ -0,0 +1,96 @@
+package gbif
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+)
+
+// Column order of the observation_history table used for bulk inserts
+var HistoryColumns = []string{"TaxonID", "CountryCode", "PreviousObservationID", "PreviousObservationDate", "ObservationID", "ObservationDate", "FetchedAt"}
+
+// Minimum years the latest observation date must move forward to count as a rediscovery
+const DefaultRediscoveryGapYears = 50.0
+
+// Gap used by SaveTaxonObservations, set from REDISCOVERY_GAP_YEARS at startup
+var RediscoveryGapYears = DefaultRediscoveryGapYears
+
+// Copies the history rows of one fetch which moved the latest observation forward by at least gapYears
+const insertRediscoveriesQuery = `INSERT OR IGNORE INTO rediscoveries
+	(HistoryID, TaxonID, CountryCode, PreviousObservationID, PreviousObservationDate, ObservationID, ObservationDate, GapYears, DetectedAt)
+	SELECT HistoryID, TaxonID, CountryCode, PreviousObservationID, PreviousObservationDate, ObservationID, ObservationDate,
+	date_diff('day', PreviousObservationDate, ObservationDate) / 365.25 AS GapYears, FetchedAt
+	FROM observation_history
+	WHERE FetchedAt = ? AND PreviousObservationDate IS NOT NULL AND ObservationDate IS NOT NULL
+	AND date_diff('day', PreviousObservationDate, ObservationDate) / 365.25 >= ?`
+
+// RecordRediscoveries persists all history entries written at fetchedAt where the latest observation date
+// moved forward by at least gapYears. Returns the number of new rediscoveries.
+func RecordRediscoveries(ctx context.Context, db internal.Execer, fetchedAt time.Time, gapYears float64) (int64, error) {
+	res, err := db.ExecContext(ctx, insertRediscoveriesQuery, fetchedAt, gapYears)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type storedObservation struct {
+	ObservationID   string
+	ObservationDate string
+}
+
+// Helper to append a history row for each country where the latest observation changed, appeared or vanished.
+// Must run inside the save transaction before the old observations are cleared.
+func recordHistory(ctx context.Context, tx *sql.Tx, taxonID string, observations []LatestObservation, fetchedAt time.Time) error {
+	previous, err := getStoredObservations(ctx, tx, taxonID)
+	if err != nil {
+		return err
+	}
+
+	writer := internal.NewBulkWriter(tx, "observation_history", HistoryColumns, internal.ConflictFail)
+	for _, obs := range observations {
+		old, ok := previous[obs.CountryCode]
+		delete(previous, obs.CountryCode)
+		if ok && old.ObservationID == obs.ObservationID {
+			continue
+		}
+		var oldID, oldDate any
+		if ok {
+			oldID, oldDate = old.ObservationID, old.ObservationDate
+		}
+		err = writer.Add(ctx, taxonID, obs.CountryCode, oldID, oldDate, obs.ObservationID, obs.ObservationDate, fetchedAt)
+		if err != nil {
+			return err
+		}
+	}
+	for country, old := range previous {
+		err = writer.Add(ctx, taxonID, country, old.ObservationID, old.ObservationDate, nil, nil, fetchedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush(ctx)
+}
+
+// Helper to get the currently stored latest observation per country of a taxon
+func getStoredObservations(ctx context.Context, tx *sql.Tx, taxonID string) (map[string]storedObservation, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT CountryCode, ObservationID::VARCHAR, strftime(ObservationDate, '%Y-%m-%d') FROM observations WHERE TaxonID = ?", taxonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := map[string]storedObservation{}
+	for rows.Next() {
+		var country string
+		var obs storedObservation
+		err = rows.Scan(&country, &obs.ObservationID, &obs.ObservationDate)
+		if err != nil {
+			return nil, err
+		}
+		stored[country] = obs
+	}
+	return stored, rows.Err()
+}
@@ -0,0 +1,191 @@
+package gbif
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Status of a fetch job
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+const (
+	DefaultFetchCooldownMinutes = 60
+	DefaultMaxFetchJobs         = 2
+)
+
+// Minimum time between two manual fetches of a taxon and running manual fetches, set from FETCH_COOLDOWN_MIN and FETCH_MAX_CONCURRENT at startup.
+// Zero disables the limit.
+var (
+	FetchCooldown = DefaultFetchCooldownMinutes * time.Minute
+	MaxFetchJobs  = DefaultMaxFetchJobs
+)
+
+// Errors of Start if a manual fetch is not allowed right now
+var (
+	ErrFetchCooldown  = errors.New("taxon was fetched recently")
+	ErrTooManyFetches = errors.New("too many fetches running")
+)
+
+const (
+	// Limit of a single manual fetch, the same as the former request timeout
+	FetchJobTimeout = 15 * time.Minute
+	// Finished jobs can be polled for this long before they are dropped
+	FetchJobRetention = time.Hour
+)
+
+// FetchJob is the state of a manual fetch running in the background, ErrorType is one of the fetch attempt error types
+type FetchJob struct {
+	ID         string        `json:"id"`
+	TaxonID    string        `json:"taxonID"`
+	Status     string        `json:"status"`
+	ErrorType  string        `json:"errorType,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Progress   FetchProgress `json:"progress"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt *time.Time    `json:"finishedAt"`
+}
+
+// Finished is true once the job is done or failed
+func (j FetchJob) Finished() bool {
+	return j.Status != JobRunning
+}
+
+type fetchJob struct {
+	job   FetchJob
+	stats *FetchStats
+	// Closed and replaced on every change of the job
+	changed chan struct{}
+}
+
+// FetchJobs runs manual fetches in the background and keeps their state in memory, the fetch itself is stored as fetch run.
+// A taxon is only fetched by one job at a time.
+type FetchJobs struct {
+	ctx    context.Context
+	client *Client
+	db     *sql.DB
+
+	mu   sync.Mutex
+	jobs map[string]*fetchJob
+}
+
+// NewFetchJobs creates the job runner, canceling the context stops all running jobs
+func NewFetchJobs(ctx context.Context, client *Client, db *sql.DB) *FetchJobs {
+	return &FetchJobs{ctx: ctx, client: client, db: db, jobs: map[string]*fetchJob{}}
+}
+
+// Start returns the running job of the taxon or starts a new one, concurrent requests for a taxon share one job.
+// A new job is refused with ErrFetchCooldown if the taxon was fetched within FetchCooldown and with ErrTooManyFetches
+// if MaxFetchJobs are running.
+func (m *FetchJobs) Start(ctx context.Context, taxonID string) (FetchJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	running := 0
+	for _, j := range m.jobs {
+		if j.job.Finished() {
+			continue
+		}
+		if j.job.TaxonID == taxonID {
+			return j.snapshot(), nil
+		}
+		running++
+	}
+
+	// Read with the lock held, a job updates LastFetch before it is marked as finished
+	var lastFetch sql.NullTime
+	err := m.db.QueryRowContext(ctx, "SELECT LastFetch FROM taxa WHERE TaxonID = ?", taxonID).Scan(&lastFetch)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return FetchJob{}, err
+	}
+	if lastFetch.Valid && time.Since(lastFetch.Time) < FetchCooldown {
+		return FetchJob{}, ErrFetchCooldown
+	}
+	if MaxFetchJobs > 0 && running >= MaxFetchJobs {
+		return FetchJob{}, ErrTooManyFetches
+	}
+
+	j := &fetchJob{
+		job:     FetchJob{ID: uuid.NewString(), TaxonID: taxonID, Status: JobRunning, StartedAt: time.Now().UTC()},
+		changed: make(chan struct{}),
+	}
+	jobCtx, cancel := context.WithTimeout(m.ctx, FetchJobTimeout)
+	jobCtx, j.stats = WithFetchStats(jobCtx, func() { m.notify(j) })
+	m.jobs[j.job.ID] = j
+	go func() {
+		defer cancel()
+		m.run(jobCtx, j)
+	}()
+	return j.snapshot(), nil
+}
+
+// Get returns the job and a channel which is closed on its next change
+func (m *FetchJobs) Get(id string) (FetchJob, <-chan struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return FetchJob{}, nil, false
+	}
+	return j.snapshot(), j.changed, true
+}
+
+// Helper to run the fetch of a job and store the outcome, a taxon without data on GBIF fails with ErrorTypeNotFound
+func (m *FetchJobs) run(ctx context.Context, j *fetchJob) {
+	taxonID := j.job.TaxonID
+	result, err := m.client.RefreshTaxa(ctx, m.db, TriggerManual, []string{taxonID})
+	if err == nil {
+		err = result.Failed[taxonID]
+	}
+	if err == nil && result.NotFound > 0 {
+		err = ErrNotFound
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	finished := time.Now().UTC()
+	j.job.FinishedAt = &finished
+	j.job.Status = JobDone
+	if err != nil {
+		j.job.Status = JobFailed
+		j.job.ErrorType, j.job.Error = ErrorType(err), err.Error()
+	}
+	j.broadcast()
+}
+
+// Helper to wake up the listeners of a job
+func (m *FetchJobs) notify(j *fetchJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j.broadcast()
+}
+
+// Helper to drop finished jobs after the retention, must be called with the lock held
+func (m *FetchJobs) sweep() {
+	for id, j := range m.jobs {
+		if j.job.FinishedAt != nil && time.Since(*j.job.FinishedAt) > FetchJobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// Helper to copy the job with the current progress, must be called with the lock held
+func (j *fetchJob) snapshot() FetchJob {
+	job := j.job
+	job.Progress = j.stats.Progress()
+	return job
+}
+
+// Helper to close the changed channel, must be called with the lock held
+func (j *fetchJob) broadcast() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
@@ -0,0 +1,188 @@
+package gbif
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRefreshBatchSize   = 25
+	DefaultRefreshStaleMonths = 6
+)
+
+// Taxa per cron run and months after which a fetched taxon is outdated, set from REFRESH_BATCH_SIZE and REFRESH_STALE_MONTHS at startup
+var (
+	RefreshBatchSize   = DefaultRefreshBatchSize
+	RefreshStaleMonths = DefaultRefreshStaleMonths
+)
+
+// A taxon is due if it was never fetched or the last fetch is at least the given months ago
+// The arguments are the current UTC time and the months
+const dueCondition = `(taxa.LastFetch IS NULL OR date_diff('month', taxa.LastFetch, CAST(? AS TIMESTAMP)) >= ?)`
+
+const enqueueOutdatedQuery = `INSERT INTO refresh_queue (TaxonID)
+	SELECT TaxonID FROM taxa WHERE isSynonym = FALSE AND ` + dueCondition + `
+	ON CONFLICT DO NOTHING`
+
+// The score keeps the order of the criteria, never fetched taxa come first, then each month of staleness
+// outweighs all demand and density, page views outweigh the number of countries with observations
+const updatePriorityQuery = `UPDATE refresh_queue SET Priority = scores.Priority FROM (
+	SELECT refresh_queue.TaxonID,
+		CASE WHEN taxa.LastFetch IS NULL THEN 1000000 ELSE 1000 * least(date_diff('month', taxa.LastFetch, CAST(? AS TIMESTAMP)), 999) END
+		+ 10 * least(refresh_queue.Demand, 99)
+		+ least(ln(1 + COUNT(observations.ObservationID)), 9) AS Priority
+	FROM refresh_queue
+	INNER JOIN taxa ON taxa.TaxonID = refresh_queue.TaxonID
+	LEFT JOIN observations ON observations.TaxonID = refresh_queue.TaxonID
+	GROUP BY refresh_queue.TaxonID, taxa.LastFetch, refresh_queue.Demand
+) AS scores WHERE refresh_queue.TaxonID = scores.TaxonID`
+
+// Failed taxa wait one hour per failed attempt, at most a day, before they are picked again
+const nextBatchQuery = `SELECT refresh_queue.TaxonID FROM refresh_queue
+	INNER JOIN taxa ON taxa.TaxonID = refresh_queue.TaxonID
+	WHERE ` + dueCondition + `
+	AND (refresh_queue.LastAttempt IS NULL OR refresh_queue.LastAttempt <= CAST(? AS TIMESTAMP) - to_hours(CAST(least(refresh_queue.Attempts, 24) AS BIGINT)))
+	ORDER BY refresh_queue.Priority DESC, refresh_queue.TaxonID
+	LIMIT ?`
+
+// RecordDemand counts a page view of the taxon, synonyms count for their accepted taxon. Taxa fetched within the stale window
+// are not queued and the demand is capped at the page views updatePriorityQuery takes into account.
+func RecordDemand(ctx context.Context, db *sql.DB, taxonID string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO refresh_queue (TaxonID, Demand)
+		SELECT taxa.TaxonID, 1 FROM taxa AS viewed
+		INNER JOIN taxa ON taxa.TaxonID = COALESCE(viewed.SynonymID, viewed.TaxonID)
+		WHERE viewed.TaxonID = ? AND `+dueCondition+`
+		ON CONFLICT (TaxonID) DO UPDATE SET Demand = least(refresh_queue.Demand + 1, 99)`, taxonID, time.Now().UTC(), RefreshStaleMonths)
+	return err
+}
+
+// Repeated page views of a client count once per taxon within this window
+const DemandWindow = 24 * time.Hour
+
+// DemandRecorder counts page views with RecordDemand, each client at most once per taxon within DemandWindow.
+// The views are kept in memory, after a restart a client counts again.
+type DemandRecorder struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewDemandRecorder() *DemandRecorder {
+	return &DemandRecorder{seen: map[string]time.Time{}}
+}
+
+// Record counts the page view of the taxon unless the client already viewed it within DemandWindow
+func (d *DemandRecorder) Record(ctx context.Context, db *sql.DB, taxonID, client string) error {
+	now := time.Now()
+	key := client + "|" + taxonID
+	d.mu.Lock()
+	if now.Sub(d.lastSweep) > time.Minute {
+		for k, seen := range d.seen {
+			if now.Sub(seen) > DemandWindow {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	seen, ok := d.seen[key]
+	if ok && now.Sub(seen) <= DemandWindow {
+		d.mu.Unlock()
+		return nil
+	}
+	d.seen[key] = now
+	d.mu.Unlock()
+	return RecordDemand(ctx, db, taxonID)
+}
+
+// NextRefreshBatch adds all outdated taxa to the queue, updates the priorities and returns the due taxa with the highest priority
+func NextRefreshBatch(ctx context.Context, db *sql.DB, batchSize, staleMonths int) ([]string, error) {
+	if batchSize <= 0 {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	added, err := db.ExecContext(ctx, enqueueOutdatedQuery, now, staleMonths)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := added.RowsAffected(); err == nil && count > 0 {
+		slog.Info("Added outdated taxa to refresh queue", "taxa", count)
+	}
+	if _, err = db.ExecContext(ctx, updatePriorityQuery, now); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, nextBatchQuery, now, staleMonths, now, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var taxonIDs []string
+	for rows.Next() {
+		var taxonID string
+		if err = rows.Scan(&taxonID); err != nil {
+			return nil, err
+		}
+		taxonIDs = append(taxonIDs, taxonID)
+	}
+	return taxonIDs, rows.Err()
+}
+
+// DrainRefreshQueue refreshes the next batch of the queue as fetch run with the given trigger, this is the flow of the cron job.
+// Taxa which are up to date afterwards leave the queue, failed taxa stay with an increased attempt count.
+func (c *Client) DrainRefreshQueue(ctx context.Context, db *sql.DB, trigger string) (RefreshResult, error) {
+	taxonIDs, err := NextRefreshBatch(ctx, db, RefreshBatchSize, RefreshStaleMonths)
+	if err != nil {
+		slog.Error("Failed to get refresh batch", "error", err)
+		return RefreshResult{}, err
+	}
+	slog.Info("Refreshing taxa from queue", "taxa", taxonIDs)
+
+	result, err := c.RefreshTaxa(ctx, db, trigger, taxonIDs)
+	// The bookkeeping must also run if the batch was canceled
+	if qErr := completeRefreshBatch(context.WithoutCancel(ctx), db, taxonIDs[:result.Attempted], result.Failed); qErr != nil {
+		slog.Error("Failed to update refresh queue", "error", qErr)
+	}
+	return result, err
+}
+
+// Helper to remove the refreshed taxa from the queue and to back off the failed ones
+func completeRefreshBatch(ctx context.Context, db *sql.DB, attempted []string, failed map[string]error) error {
+	if len(attempted) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(attempted)), ",")
+	now := time.Now().UTC()
+	args := make([]any, 0, len(attempted)+2)
+	args = append(args, now, RefreshStaleMonths)
+	for _, id := range attempted {
+		args = append(args, id)
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM refresh_queue WHERE TaxonID IN (
+		SELECT TaxonID FROM taxa WHERE NOT `+dueCondition+` AND TaxonID IN (`+placeholders+`))`, args...)
+	if err != nil {
+		return err
+	}
+
+	for id := range failed {
+		_, err = db.ExecContext(ctx, "UPDATE refresh_queue SET Attempts = Attempts + 1, LastAttempt = ? WHERE TaxonID = ?", now, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRefreshQueueLength counts the queued taxa which are due for a refresh
+func GetRefreshQueueLength(ctx context.Context, db *sql.DB) int {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM refresh_queue
+		INNER JOIN taxa ON taxa.TaxonID = refresh_queue.TaxonID WHERE `+dueCondition, time.Now().UTC(), RefreshStaleMonths).Scan(&count)
+	if err != nil {
+		slog.Error("Failed to count refresh queue", "error", err)
+	}
+	return count
+}
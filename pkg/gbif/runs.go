@@ -0,0 +1,223 @@
+package gbif
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Triggers of a fetch run
+const (
+	TriggerCron   = "cron"
+	TriggerManual = "manual"
+	TriggerCLI    = "cli"
+)
+
+// Error types of a fetch attempt
+const (
+	ErrorTypeNotFound    = "not_found"
+	ErrorTypeRateLimited = "rate_limited"
+	ErrorTypeUpstream    = "upstream"
+	ErrorTypeSave        = "save"
+	ErrorTypeCanceled    = "canceled"
+	ErrorTypeOther       = "other"
+)
+
+// ErrSave is returned by RefreshTaxon if the fetched observations could not be saved
+var ErrSave = errors.New("failed to save observations")
+
+type fetchStatsKey struct{}
+
+// FetchStats counts the GBIF requests and tracks the progress of all fetches made with the context, see WithFetchStats
+type FetchStats struct {
+	requests atomic.Int64
+	onChange func()
+
+	mu        sync.Mutex
+	years     int
+	countries int
+	pages     map[string]int
+}
+
+// FetchProgress is a snapshot of FetchStats, Pages counts the fetched occurrence pages per country
+type FetchProgress struct {
+	Requests  int            `json:"requests"`
+	Years     int            `json:"years"`
+	Countries int            `json:"countries"`
+	Pages     map[string]int `json:"pages"`
+}
+
+// WithFetchStats returns a context which counts the requests made by the client, onChange is called after each update and can be nil
+func WithFetchStats(ctx context.Context, onChange func()) (context.Context, *FetchStats) {
+	stats := &FetchStats{onChange: onChange, pages: map[string]int{}}
+	return context.WithValue(ctx, fetchStatsKey{}, stats), stats
+}
+
+// Requests made so far, including retries
+func (s *FetchStats) Requests() int {
+	return int(s.requests.Load())
+}
+
+// Progress returns a copy of the current stats
+func (s *FetchStats) Progress() FetchProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pages := make(map[string]int, len(s.pages))
+	for country, count := range s.pages {
+		pages[country] = count
+	}
+	return FetchProgress{Requests: s.Requests(), Years: s.years, Countries: s.countries, Pages: pages}
+}
+
+// Helper to get the stats of the context, nil if there are none
+func statsFrom(ctx context.Context) *FetchStats {
+	stats, _ := ctx.Value(fetchStatsKey{}).(*FetchStats)
+	return stats
+}
+
+// Helper to run an update and notify the listener, the listener is called without holding the lock
+func (s *FetchStats) update(f func()) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	f()
+	s.mu.Unlock()
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// Helper to count a request if the context carries FetchStats
+func countRequest(ctx context.Context) {
+	stats := statsFrom(ctx)
+	stats.update(func() { stats.requests.Add(1) })
+}
+
+// Helper to report the years and countries with observations found by the facets
+func foundFacets(ctx context.Context, years, countries int) {
+	stats := statsFrom(ctx)
+	stats.update(func() {
+		stats.years, stats.countries = years, countries
+	})
+}
+
+// Helper to count a fetched page of observations of a country
+func countPage(ctx context.Context, country string) {
+	stats := statsFrom(ctx)
+	stats.update(func() { stats.pages[country]++ })
+}
+
+// StartRun inserts a new fetch run and returns its id
+func StartRun(ctx context.Context, db *sql.DB, trigger string) (int64, error) {
+	var runID int64
+	err := db.QueryRowContext(ctx, "INSERT INTO fetch_runs (TriggeredBy, StartedAt) VALUES (?, ?) RETURNING RunID", trigger, time.Now().UTC()).Scan(&runID)
+	return runID, err
+}
+
+// FinishRun writes the counts of the result and the error which stopped the run early, if any
+func FinishRun(ctx context.Context, db *sql.DB, runID int64, result RefreshResult, runErr error) error {
+	var message any
+	if runErr != nil {
+		message = runErr.Error()
+	}
+	_, err := db.ExecContext(ctx, `UPDATE fetch_runs SET FinishedAt = ?, Attempted = ?, Succeeded = ?, NotFound = ?, Failed = ?, Error = ? WHERE RunID = ?`,
+		time.Now().UTC(), result.Attempted, result.Updated, result.NotFound, len(result.Failed), message, runID)
+	return err
+}
+
+// Helper to store one attempt, a missing run is not an error as the fetch itself should not fail because of the bookkeeping
+func recordAttempt(ctx context.Context, db *sql.DB, runID int64, taxonID string, started time.Time, requests, countries int, fetchErr error) {
+	if runID == 0 {
+		return
+	}
+	var errorType, statusCode, message any
+	if fetchErr != nil {
+		errorType, message = ErrorType(fetchErr), fetchErr.Error()
+		var reqErr *RequestError
+		if errors.As(fetchErr, &reqErr) && reqErr.StatusCode != 0 {
+			statusCode = reqErr.StatusCode
+		}
+	}
+	_, err := db.ExecContext(context.WithoutCancel(ctx), `INSERT INTO fetch_attempts
+		(RunID, TaxonID, StartedAt, DurationMs, Requests, Countries, ErrorType, StatusCode, Error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		runID, taxonID, started, time.Since(started).Milliseconds(), requests, countries, errorType, statusCode, message)
+	if err != nil {
+		slog.Error("Failed to record fetch attempt", "runID", runID, "taxonID", taxonID, "error", err)
+	}
+}
+
+// ErrorType classifies the error of a fetch attempt, empty for nil
+func ErrorType(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNotFound):
+		return ErrorTypeNotFound
+	case errors.Is(err, ErrRateLimited):
+		return ErrorTypeRateLimited
+	case errors.Is(err, ErrUpstream):
+		return ErrorTypeUpstream
+	case errors.Is(err, ErrSave):
+		return ErrorTypeSave
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeCanceled
+	default:
+		return ErrorTypeOther
+	}
+}
+
+// RefreshTaxon fetches and saves the latest observations of one taxon and records the attempt in the run.
+// Taxa without data on GBIF are marked as fetched and ErrNotFound is returned, save failures are wrapped in ErrSave.
+func (c *Client) RefreshTaxon(ctx context.Context, db *sql.DB, runID int64, taxonID string) error {
+	started := time.Now().UTC()
+	// Keep the stats of the caller, e.g. of a fetch job, so its progress stays up to date
+	stats := statsFrom(ctx)
+	if stats == nil {
+		ctx, stats = WithFetchStats(ctx, nil)
+	}
+	requests := stats.Requests()
+	res, err := c.FetchLatest(ctx, taxonID)
+	countries := 0
+	if err == nil {
+		countries = len(*res)
+		if countries == 0 {
+			err = ErrNotFound
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		UpdateLastFetchStatus(ctx, db, taxonID)
+	case err == nil:
+		if saveErr := SaveTaxonObservations(ctx, db, taxonID, *res); saveErr != nil {
+			err = fmt.Errorf("%w: %w", ErrSave, saveErr)
+		}
+	}
+	recordAttempt(ctx, db, runID, taxonID, started, stats.Requests()-requests, countries, err)
+	return err
+}
+
+// Helper to start a run, if the run can not be stored the fetch continues without history
+func startRun(ctx context.Context, db *sql.DB, trigger string) int64 {
+	runID, err := StartRun(ctx, db, trigger)
+	if err != nil {
+		slog.Error("Failed to start fetch run", "trigger", trigger, "error", err)
+		return 0
+	}
+	return runID
+}
+
+// Helper to finish a run, see startRun
+func finishRun(ctx context.Context, db *sql.DB, runID int64, result RefreshResult, runErr error) {
+	if runID == 0 {
+		return
+	}
+	if err := FinishRun(context.WithoutCancel(ctx), db, runID, result, runErr); err != nil {
+		slog.Error("Failed to finish fetch run", "runID", runID, "error", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Purpose: Render the per country statistics as GeoJSON and as SVG choropleth from the bundled country shapes, no tile service needed
+package maps
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+)
+
+// Metrics of the years since the latest observation which can be used to colour the countries
+const (
+	MetricMedian = "median"
+	MetricMax    = "max"
+)
+
+var Metrics = []string{MetricMedian, MetricMax}
+
+// Fill colours of the year classes from queries.YearBucketLabels, from recently seen to long unseen
+var _classColors = []string{"#ffffb2", "#fecc5c", "#fd8d3c", "#f03b20", "#bd0026"}
+
+const noDataColor = "#e5e7eb"
+
+// Equirectangular projection of the whole world, the legend is drawn below the map
+const (
+	mapWidth     = 1000.0
+	mapHeight    = mapWidth / 2
+	legendHeight = 60.0
+)
+
+// ParseMetric returns the median as default for an empty value
+func ParseMetric(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return MetricMedian, nil
+	}
+	for _, metric := range Metrics {
+		if metric == value {
+			return metric, nil
+		}
+	}
+	return "", fmt.Errorf("unknown metric %q, use one of %s", value, strings.Join(Metrics, ", "))
+}
+
+// Helper to get the years of the metric
+func metricYears(stats queries.CountryStats, metric string) float64 {
+	if metric == MetricMax {
+		return stats.MaxYears
+	}
+	return stats.MedianYears
+}
+
+// Color of the country fill for the metric
+func Color(stats queries.CountryStats, metric string) string {
+	return _classColors[queries.YearBucketIndex(metricYears(stats, metric))]
+}
+
+type feature struct {
+	Type       string     `json:"type"`
+	Geometry   *geometry  `json:"geometry"`
+	Properties properties `json:"properties"`
+}
+
+type geometry struct {
+	Type        string           `json:"type"`
+	Coordinates [][][][2]float64 `json:"coordinates"`
+}
+
+// Statistics are null for countries without taxa in the filtered set
+type properties struct {
+	Code        string   `json:"code"`
+	Name        string   `json:"name"`
+	TaxaCount   *int     `json:"taxaCount"`
+	MedianYears *float64 `json:"medianYears"`
+	MaxYears    *float64 `json:"maxYears"`
+}
+
+// GeoJSON FeatureCollection with one MultiPolygon per bundled shape, countries with statistics but without shape,
+// e.g. small islands, are added with a null geometry
+func GeoJSON(stats []queries.CountryStats) ([]byte, error) {
+	byCode := make(map[string]queries.CountryStats, len(stats))
+	for _, s := range stats {
+		byCode[s.CountryCode] = s
+	}
+
+	features := make([]feature, 0, len(countries.Shapes())+len(stats))
+	for _, shape := range countries.Shapes() {
+		f := feature{Type: "Feature", Geometry: &geometry{Type: "MultiPolygon", Coordinates: shape.Polygons}, Properties: properties{Code: shape.Code, Name: countries.Name(shape.Code)}}
+		if s, ok := byCode[shape.Code]; ok {
+			f.Properties.setStats(s)
+			delete(byCode, shape.Code)
+		}
+		features = append(features, f)
+	}
+	for _, s := range stats {
+		if _, ok := byCode[s.CountryCode]; !ok {
+			continue
+		}
+		f := feature{Type: "Feature", Properties: properties{Code: s.CountryCode, Name: s.CountryName}}
+		f.Properties.setStats(s)
+		features = append(features, f)
+	}
+
+	return json.Marshal(struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{"FeatureCollection", features})
+}
+
+func (p *properties) setStats(s queries.CountryStats) {
+	taxa, median, maxYears := s.TaxaCount, round(s.MedianYears), round(s.MaxYears)
+	p.TaxaCount, p.MedianYears, p.MaxYears = &taxa, &median, &maxYears
+}
+
+func round(x float64) float64 {
+	return math.Round(x*10) / 10
+}
+
+// SVG choropleth coloured by the year classes of the metric, each country links to its profile.
+// The caption is written above the legend, e.g. the applied filters.
+func SVG(w io.Writer, stats []queries.CountryStats, metric, caption string) error {
+	byCode := make(map[string]queries.CountryStats, len(stats))
+	for _, s := range stats {
+		byCode[s.CountryCode] = s
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %.0f %.0f" font-family="monospace" font-size="12">`+"\n", mapWidth, mapHeight+legendHeight)
+	fmt.Fprintf(&b, `<rect width="%.0f" height="%.0f" fill="#ffffff"/>`+"\n", mapWidth, mapHeight+legendHeight)
+	b.WriteString(`<g stroke="#ffffff" stroke-width="0.3" fill-rule="evenodd">` + "\n")
+	for _, shape := range countries.Shapes() {
+		name := countries.Name(shape.Code)
+		fill, title := noDataColor, fmt.Sprintf("%s (%s): no data", name, shape.Code)
+		if s, ok := byCode[shape.Code]; ok {
+			fill = Color(s, metric)
+			title = fmt.Sprintf("%s (%s): %d taxa, median %.1f years, max %.1f years", name, shape.Code, s.TaxaCount, s.MedianYears, s.MaxYears)
+		}
+		fmt.Fprintf(&b, `<a href="/country/%s"><path fill="%s" d="%s"><title>%s</title></path></a>`+"\n", shape.Code, fill, pathData(shape), html.EscapeString(title))
+	}
+	b.WriteString("</g>\n")
+
+	y := mapHeight + 15
+	if caption != "" {
+		fmt.Fprintf(&b, `<text x="10" y="%.0f">%s</text>`+"\n", y, html.EscapeString(caption))
+	}
+	y += 10
+	x := 10.0
+	labels := append(queries.YearBucketLabels(), "No data")
+	colors := append(append([]string{}, _classColors...), noDataColor)
+	fmt.Fprintf(&b, `<text x="%.0f" y="%.0f">%s years since latest observation:</text>`+"\n", x, y+12, html.EscapeString(metricLabel(metric)))
+	x += 330
+	for i, label := range labels {
+		fmt.Fprintf(&b, `<rect x="%.0f" y="%.0f" width="14" height="14" fill="%s"/>`+"\n", x, y+1, colors[i])
+		fmt.Fprintf(&b, `<text x="%.0f" y="%.0f">%s</text>`+"\n", x+18, y+12, html.EscapeString(label))
+		x += 22 + float64(len(label))*8
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func metricLabel(metric string) string {
+	if metric == MetricMax {
+		return "Maximum"
+	}
+	return "Median"
+}
+
+// Helper to project the longitude, latitude rings into the SVG path, one decimal is enough for the map size
+func pathData(shape countries.Shape) string {
+	var b strings.Builder
+	for _, polygon := range shape.Polygons {
+		for _, ring := range polygon {
+			for i, point := range ring {
+				if i == 0 {
+					b.WriteString("M")
+				} else {
+					b.WriteString("L")
+				}
+				x := (point[0] + 180) / 360 * mapWidth
+				y := (90 - point[1]) / 180 * mapHeight
+				fmt.Fprintf(&b, "%.1f %.1f", x, y)
+			}
+			b.WriteString("Z")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package maps
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+)
+
+var demoStats = []queries.CountryStats{
+	{CountryCode: "AT", CountryName: "Austria", TaxaCount: 3, MedianYears: 12.34, MaxYears: 120},
+	{CountryCode: "MC", CountryName: "Monaco", TaxaCount: 1, MedianYears: 1, MaxYears: 1},
+}
+
+func TestParseMetric(t *testing.T) {
+	for value, want := range map[string]string{"": MetricMedian, "MAX": MetricMax, " median ": MetricMedian} {
+		if got, err := ParseMetric(value); err != nil || got != want {
+			t.Errorf("got %s %v, wanted %s", got, err, want)
+		}
+	}
+	if _, err := ParseMetric("mean"); err == nil {
+		t.Errorf("got %v, wanted error", err)
+	}
+}
+
+func TestGeoJSON(t *testing.T) {
+	body, err := GeoJSON(demoStats)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	var collection struct {
+		Type     string
+		Features []struct {
+			Geometry   *struct{ Type string }
+			Properties struct {
+				Code        string
+				TaxaCount   *int
+				MedianYears *float64
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &collection); err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if collection.Type != "FeatureCollection" {
+		t.Errorf("got %s, wanted %s", collection.Type, "FeatureCollection")
+	}
+	found := map[string]bool{}
+	for _, f := range collection.Features {
+		switch f.Properties.Code {
+		case "AT":
+			if f.Geometry == nil || f.Properties.TaxaCount == nil || *f.Properties.MedianYears != 12.3 {
+				t.Errorf("got %v, wanted geometry and median %f", f, 12.3)
+			}
+		case "MC":
+			/* Monaco is too small for the bundled shapes */
+			if f.Geometry != nil || *f.Properties.TaxaCount != 1 {
+				t.Errorf("got %v, wanted null geometry", f)
+			}
+		case "DE":
+			if f.Properties.TaxaCount != nil {
+				t.Errorf("got %d, wanted null", *f.Properties.TaxaCount)
+			}
+		}
+		found[f.Properties.Code] = true
+	}
+	if !found["AT"] || !found["MC"] || !found["DE"] {
+		t.Errorf("got %v, wanted AT, MC and DE", found)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	var b strings.Builder
+	if err := SVG(&b, demoStats, MetricMax, "country=AT & more"); err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	svg := b.String()
+	for _, want := range []string{
+		`<a href="/country/AT"><path fill="#bd0026"`,
+		`<a href="/country/DE"><path fill="` + noDataColor + `"`,
+		"Austria (AT): 3 taxa, median 12.3 years, max 120.0 years",
+		"country=AT &amp; more",
+		"Maximum years since latest observation",
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("got svg without %q", want)
+		}
+	}
+	if Color(demoStats[0], MetricMedian) != "#fecc5c" {
+		t.Errorf("got %s, wanted %s", Color(demoStats[0], MetricMedian), "#fecc5c")
+	}
+}
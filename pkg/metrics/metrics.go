@@ -0,0 +1,110 @@
+// Purpose: Prometheus metrics of the server, the GBIF client, the cron job and the database queries
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gbif_extinct"
+
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route pattern, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	GbifRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gbif_requests_total",
+		Help:      "Requests sent to the GBIF API by status code, including retries. Requests without a response are counted as status error.",
+	}, []string{"status"})
+
+	FetchLatestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fetch_latest_duration_seconds",
+		Help:      "Duration of fetching the latest observations of a taxon from GBIF by outcome.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 900},
+	}, []string{"outcome"})
+
+	CronBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_batches_total",
+		Help:      "Cron batches by outcome: success, partial if some taxa failed or stopped if the batch ended early.",
+	}, []string{"outcome"})
+
+	CronTaxa = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_taxa_total",
+		Help:      "Taxa refreshed by the cron job by result: updated, not_found or failed.",
+	}, []string{"result"})
+
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of DuckDB queries by name.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"query"})
+)
+
+// Outcomes of a cron batch
+const (
+	CronSuccess = "success"
+	CronPartial = "partial"
+	CronStopped = "stopped"
+)
+
+// Handler serves all registered metrics in the Prometheus text format
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Middleware records the duration of each request, the route pattern is used as label to keep the number of series small
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			}
+			route := c.Path()
+			if route == "" || status == http.StatusNotFound && c.Path() == "/*" {
+				route = "unmatched"
+			}
+			HTTPRequestDuration.WithLabelValues(route, c.Request().Method, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// ObserveQuery records the duration of a database query since start, use it with defer
+func ObserveQuery(name string, start time.Time) {
+	QueryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// RegisterFetchedTaxa exports the taxa fetched in the past 12 months, the count is queried on every scrape
+func RegisterFetchedTaxa(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "taxa_fetched_last_twelve_months",
+		Help:      "Accepted taxa fetched from GBIF in the past 12 months.",
+	}, func() float64 {
+		return float64(count())
+	})
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware())
+	e.GET("/taxon/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Param("id"))
+	})
+	e.GET("/broken", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadGateway, "broken")
+	})
+	e.GET("/metrics", Handler())
+
+	for _, url := range []string{"/taxon/1", "/taxon/2", "/broken", "/missing"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	/* Both taxa share the route pattern */
+	if got := testutil.CollectAndCount(HTTPRequestDuration, "gbif_extinct_http_request_duration_seconds"); got != 3 {
+		t.Errorf("got %d, wanted %d series", got, 3)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`gbif_extinct_http_request_duration_seconds_count{method="GET",route="/taxon/:id",status="200"} 2`,
+		`gbif_extinct_http_request_duration_seconds_count{method="GET",route="/broken",status="502"} 1`,
+		`route="unmatched",status="404"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("got metrics without %s", want)
+		}
+	}
+}
+
+func TestRegisterFetchedTaxa(t *testing.T) {
+	RegisterFetchedTaxa(func() int { return 42 })
+	rec := httptest.NewRecorder()
+	Handler()(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/metrics", nil), rec))
+	if !strings.Contains(rec.Body.String(), "gbif_extinct_taxa_fetched_last_twelve_months 42") {
+		t.Errorf("got metrics without %s", "gbif_extinct_taxa_fetched_last_twelve_months 42")
+	}
+}
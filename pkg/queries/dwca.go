@@ -0,0 +1,183 @@
+package queries
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
+	sq "github.com/Masterminds/squirrel"
+)
+
+const dwcTerms = "http://rs.tdwg.org/dwc/terms/"
+
+// Occurrence core of the Darwin Core Archive, one row per latest observation of an accepted taxon and country
+var _dwcaFields = []struct{ term, sql string }{
+	{dwcTerms + "occurrenceID", "'" + gbif.OccurrenceURL + "' || ObservationID"},
+	{"http://rs.gbif.org/terms/1.0/gbifID", "CAST(ObservationID AS VARCHAR)"},
+	{dwcTerms + "basisOfRecord", "'Occurrence'"},
+	{dwcTerms + "eventDate", "strftime(ObservationDate, '%Y-%m-%d')"},
+	{dwcTerms + "verbatimEventDate", "ObservationDateOriginal"},
+	{dwcTerms + "countryCode", "CountryCode"},
+	{dwcTerms + "country", "CountryCode"}, // Replaced by the bundled country name
+	{dwcTerms + "taxonID", "CAST(taxa.TaxonID AS VARCHAR)"},
+	{dwcTerms + "scientificName", "ScientificName"},
+	{dwcTerms + "kingdom", "COALESCE(TaxonKingdom, '')"},
+	{dwcTerms + "phylum", "COALESCE(TaxonPhylum, '')"},
+	{dwcTerms + "class", "COALESCE(TaxonClass, '')"},
+	{dwcTerms + "order", "COALESCE(TaxonOrder, '')"},
+	{dwcTerms + "family", "COALESCE(TaxonFamily, '')"},
+	{dwcTerms + "genus", "COALESCE(TaxonGenus, '')"},
+}
+
+// Index of the country name in _dwcaFields
+const dwcaCountryField = 6
+
+// Helper to write a Darwin Core Archive with meta.xml, eml.xml and the occurrence core streamed from the filtered query.
+// Synonyms are skipped as their observations belong to the accepted taxon, which keeps the occurrenceID unique.
+func (q Query) writeDwCA(ctx context.Context, db *sql.DB, w io.Writer) (int, error) {
+	q.SHOW_SYNONYMS = false
+	selects := make([]string, len(_dwcaFields))
+	for i, field := range _dwcaFields {
+		selects[i] = field.sql
+	}
+	query, args, err := q.tableQuery(selects...).Where(sq.NotEq{"ObservationID": nil}).ToSql()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	archive := zip.NewWriter(w)
+	if err = writeZipFile(archive, "meta.xml", dwcaMeta()); err != nil {
+		return 0, err
+	}
+	if err = writeZipFile(archive, "eml.xml", q.dwcaEML(time.Now())); err != nil {
+		return 0, err
+	}
+	core, err := archive.Create("occurrence.txt")
+	if err != nil {
+		return 0, err
+	}
+
+	record := make([]string, len(_dwcaFields))
+	values := make([]any, len(_dwcaFields))
+	for i := range record {
+		values[i] = &record[i]
+	}
+	header := make([]string, len(_dwcaFields))
+	for i, field := range _dwcaFields {
+		header[i] = field.term[strings.LastIndex(field.term, "/")+1:]
+	}
+	if _, err = io.WriteString(core, strings.Join(header, "\t")+"\n"); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for rows.Next() {
+		if err = rows.Scan(values...); err != nil {
+			return count, err
+		}
+		record[dwcaCountryField] = countries.Name(record[dwcaCountryField])
+		for i, value := range record {
+			record[i] = dwcaValue(value)
+		}
+		if _, err = io.WriteString(core, strings.Join(record, "\t")+"\n"); err != nil {
+			return count, err
+		}
+		count++
+		if count%exportFlushRows == 0 {
+			if err = archive.Flush(); err != nil {
+				return count, err
+			}
+			flushWriter(w)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	return count, archive.Close()
+}
+
+func writeZipFile(archive *zip.Writer, name, content string) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, content)
+	return err
+}
+
+// The core is written without enclosing quotes, so tabs and line breaks are replaced
+func dwcaValue(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func dwcaMeta() string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<archive xmlns="http://rs.tdwg.org/dwc/text/" metadata="eml.xml">` + "\n")
+	b.WriteString(`  <core encoding="UTF-8" fieldsTerminatedBy="\t" linesTerminatedBy="\n" fieldsEnclosedBy="" ignoreHeaderLines="1" rowType="` + dwcTerms + `Occurrence">` + "\n")
+	b.WriteString("    <files><location>occurrence.txt</location></files>\n")
+	b.WriteString(`    <id index="0"/>` + "\n")
+	for i, field := range _dwcaFields {
+		fmt.Fprintf(&b, `    <field index="%d" term="%s"/>`+"\n", i, field.term)
+	}
+	b.WriteString("  </core>\n</archive>\n")
+	return b.String()
+}
+
+// Dataset metadata in EML 2.1.1, the abstract lists the applied filters
+func (q Query) dwcaEML(now time.Time) string {
+	filters := q.DescribeFilters()
+	if filters == "" {
+		filters = "none"
+	}
+	abstract := "Latest GBIF observation per taxon and country exported from GBIF-Extinct (https://github.com/HannesOberreiter/gbif-extinct). Filters: " + filters + "."
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<eml:eml xmlns:eml="eml://ecoinformatics.org/eml-2.1.1" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="eml://ecoinformatics.org/eml-2.1.1 http://rs.gbif.org/schema/eml-gbif-profile/1.1/eml.xsd" packageId="gbif-extinct-` + now.UTC().Format("20060102150405") + `" system="https://github.com/HannesOberreiter/gbif-extinct" xml:lang="en">` + "\n")
+	b.WriteString("  <dataset>\n")
+	b.WriteString("    <title>GBIF-Extinct latest observations</title>\n")
+	b.WriteString("    <creator><organizationName>GBIF-Extinct</organizationName></creator>\n")
+	b.WriteString("    <pubDate>" + now.UTC().Format("2006-01-02") + "</pubDate>\n")
+	b.WriteString("    <language>en</language>\n")
+	b.WriteString("    <abstract><para>")
+	xml.EscapeText(&b, []byte(abstract))
+	b.WriteString("</para></abstract>\n")
+	b.WriteString("    <contact><organizationName>GBIF-Extinct</organizationName></contact>\n")
+	b.WriteString("  </dataset>\n</eml:eml>\n")
+	return b.String()
+}
+
+// DescribeFilters lists the set filters as "name=value" pairs in the order of the query parameters
+func (q Query) DescribeFilters() string {
+	var filters []string
+	for _, f := range []struct{ name, value string }{
+		{"search", q.SEARCH},
+		{"country", q.COUNTRY},
+		{"exclude_country", q.EXCLUDE_COUNTRY},
+		{"region", q.REGION},
+		{"rank", q.RANK},
+		{"taxa", q.TAXA},
+		{"observed_before", q.OBSERVED_BEFORE},
+		{"observed_after", q.OBSERVED_AFTER},
+		{"min_years", q.MIN_YEARS},
+		{"max_years", q.MAX_YEARS},
+	} {
+		if f.value != "" {
+			filters = append(filters, f.name+"="+f.value)
+		}
+	}
+	return strings.Join(filters, ", ")
+}
@@ -0,0 +1,338 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
+)
+
+// Value kinds of the export columns, used for typed NDJSON, Excel and Parquet output
+const (
+	kindString  = "string"
+	kindInteger = "integer"
+	kindNumber  = "number"
+	kindBoolean = "boolean"
+	kindDate    = "date"
+)
+
+// ExportColumn is a column of the download, sql is the expression used for Parquet which is written by DuckDB
+type ExportColumn struct {
+	Name  string
+	kind  string
+	sql   string
+	value func(row TableRow) string
+}
+
+// All export columns in default order, the columns of _selectArray followed by the derived ones
+var ExportColumns = []ExportColumn{
+	{"TaxonID", kindInteger, "taxa.TaxonID", func(row TableRow) string { return row.TaxonID }},
+	{"ScientificName", kindString, "ScientificName", func(row TableRow) string { return row.ScientificName.String }},
+	{"CountryCode", kindString, "CountryCode", func(row TableRow) string { return row.CountryCode.String }},
+	{"CountryName", kindString, "country_names.CountryName", func(row TableRow) string { return row.CountryName }},
+	{"CountryFlag", kindString, "country_names.CountryFlag", func(row TableRow) string { return strings.TrimSpace(row.CountryFlag) }},
+	{"LastFetch", kindDate, "CAST(LastFetch AS DATE)", func(row TableRow) string { return formatDate(row.LastFetch) }},
+	{"ObservationID", kindInteger, "ObservationID", func(row TableRow) string { return row.ObservationID.String }},
+	{"ObservationDate", kindDate, "ObservationDate", func(row TableRow) string { return formatDate(row.ObservationDate) }},
+	{"YearsSinceObservation", kindNumber, "round(" + _yearsSinceObservation + ", 1)", yearsSinceObservation},
+	{"TaxonKingdom", kindString, "TaxonKingdom", func(row TableRow) string { return row.TaxonKingdom }},
+	{"TaxonPhylum", kindString, "TaxonPhylum", func(row TableRow) string { return row.TaxonPhylum }},
+	{"TaxonClass", kindString, "TaxonClass", func(row TableRow) string { return row.TaxonClass }},
+	{"TaxonOrder", kindString, "TaxonOrder", func(row TableRow) string { return row.TaxonOrder }},
+	{"TaxonFamily", kindString, "TaxonFamily", func(row TableRow) string { return row.TaxonFamily }},
+	{"isSynonym", kindBoolean, "isSynonym", func(row TableRow) string { return strconv.FormatBool(row.IsSynonym) }},
+	{"SynonymName", kindString, "SynonymName", func(row TableRow) string { return row.SynonymName.String }},
+	{"SynonymID", kindInteger, "SynonymID", func(row TableRow) string { return row.SynonymID.String }},
+}
+
+// Supported download formats, the first one is the default
+var ExportFormats = []string{"csv", "tsv", "ndjson", "xlsx", "parquet", "dwca"}
+
+var _exportContentTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"tsv":     "text/tab-separated-values; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"parquet": "application/vnd.apache.parquet",
+	"dwca":    "application/zip",
+}
+
+// Rows between two flushes of the export writer, so a download starts before the query is done
+const exportFlushRows = 1_000
+
+// ParseExportColumns selects export columns from a comma separated list of names, case insensitive. An empty list returns all columns.
+func ParseExportColumns(value string) ([]ExportColumn, error) {
+	if strings.TrimSpace(value) == "" {
+		return ExportColumns, nil
+	}
+	var columns []ExportColumn
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, column := range ExportColumns {
+			if strings.EqualFold(column.Name, name) {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// ParseExportFormat returns the lower case format and its content type, an empty format is CSV
+func ParseExportFormat(value string) (format, contentType string, err error) {
+	format = strings.ToLower(strings.TrimSpace(value))
+	if format == "" {
+		format = ExportFormats[0]
+	}
+	if !slices.Contains(ExportFormats, format) {
+		return "", "", fmt.Errorf("format must be one of %s", strings.Join(ExportFormats, ", "))
+	}
+	return format, _exportContentTypes[format], nil
+}
+
+// Export writes all rows matching the query without paging to w in the given format and returns the number of rows.
+// Row based formats are streamed from the database cursor, Parquet is written by DuckDB into a temporary file first.
+// The Darwin Core Archive has a fixed set of columns and ignores the column selection.
+func (q Query) Export(ctx context.Context, db *sql.DB, w io.Writer, columns []ExportColumn, format string) (int, error) {
+	switch format {
+	case "csv":
+		return q.writeRows(ctx, db, newDelimitedWriter(w, columns, ','))
+	case "tsv":
+		return q.writeRows(ctx, db, newDelimitedWriter(w, columns, '\t'))
+	case "ndjson":
+		return q.writeRows(ctx, db, newNDJSONWriter(w, columns))
+	case "xlsx":
+		return q.writeRows(ctx, db, newXLSXWriter(w, columns))
+	case "parquet":
+		return q.writeParquet(ctx, db, w, columns)
+	case "dwca":
+		return q.writeDwCA(ctx, db, w)
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// Helper interface to encode export rows, flush is called regularly while streaming and close once after the last row
+type rowWriter interface {
+	header() error
+	row(row TableRow) error
+	flush() error
+	close() error
+}
+
+// Helper to stream all rows matching the query without paging from the database cursor into the row writer
+func (q Query) writeRows(ctx context.Context, db *sql.DB, writer rowWriter) (int, error) {
+	query, args, err := q.tableQuery().ToSql()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if err = writer.header(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for rows.Next() {
+		row, err := scanTableRow(rows)
+		if err != nil {
+			return count, fmt.Errorf("scan export row: %w", err)
+		}
+		if err = writer.row(row); err != nil {
+			return count, err
+		}
+		count++
+		if count%exportFlushRows == 0 {
+			if err = writer.flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	return count, writer.close()
+}
+
+// Helper to let DuckDB copy the filtered query into a Parquet file, the file is then copied to w and removed
+func (q Query) writeParquet(ctx context.Context, db *sql.DB, w io.Writer, columns []ExportColumn) (int, error) {
+	selects := make([]string, len(columns))
+	for i, column := range columns {
+		selects[i] = column.sql + " AS " + column.Name
+	}
+	query, args, err := q.tableQuery(selects...).
+		Prefix(countryNamesCTE()).
+		JoinClause("LEFT OUTER JOIN country_names ON country_names.Code = observations.CountryCode").
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp("", "gbif-extinct-*.parquet")
+	if err != nil {
+		return 0, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	result, err := db.ExecContext(ctx, "COPY ("+query+") TO '"+strings.ReplaceAll(file.Name(), "'", "''")+"' (FORMAT PARQUET)", args...)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := result.RowsAffected()
+
+	file, err = os.Open(file.Name())
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return int(count), err
+}
+
+// Helper to build the bundled country names and flags as common table expression, so DuckDB can join them
+func countryNamesCTE() string {
+	var b strings.Builder
+	b.WriteString("WITH country_names (Code, CountryName, CountryFlag) AS (VALUES ")
+	for i, c := range countries.All() {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		_, flag := countryCodeToFlag(c.Code)
+		fmt.Fprintf(&b, "('%s', '%s', '%s')", c.Code, strings.ReplaceAll(c.Name, "'", "''"), strings.TrimSpace(flag))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// CSV and TSV writer, fields are quoted where needed
+type delimitedWriter struct {
+	csv     *csv.Writer
+	out     io.Writer
+	columns []ExportColumn
+	record  []string
+}
+
+func newDelimitedWriter(w io.Writer, columns []ExportColumn, separator rune) *delimitedWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = separator
+	return &delimitedWriter{csv: writer, out: w, columns: columns, record: make([]string, len(columns))}
+}
+
+func (e *delimitedWriter) header() error {
+	for i, column := range e.columns {
+		e.record[i] = column.Name
+	}
+	return e.csv.Write(e.record)
+}
+
+func (e *delimitedWriter) row(row TableRow) error {
+	for i, column := range e.columns {
+		e.record[i] = column.value(row)
+	}
+	return e.csv.Write(e.record)
+}
+
+func (e *delimitedWriter) flush() error {
+	e.csv.Flush()
+	if err := e.csv.Error(); err != nil {
+		return err
+	}
+	flushWriter(e.out)
+	return nil
+}
+
+func (e *delimitedWriter) close() error {
+	return e.flush()
+}
+
+// Newline delimited JSON writer, one object per row with typed values and null for empty values
+type ndjsonWriter struct {
+	out     io.Writer
+	columns []ExportColumn
+	line    []byte
+}
+
+func newNDJSONWriter(w io.Writer, columns []ExportColumn) *ndjsonWriter {
+	return &ndjsonWriter{out: w, columns: columns}
+}
+
+func (n *ndjsonWriter) header() error {
+	return nil
+}
+
+func (n *ndjsonWriter) row(row TableRow) error {
+	n.line = append(n.line[:0], '{')
+	for i, column := range n.columns {
+		if i > 0 {
+			n.line = append(n.line, ',')
+		}
+		n.line = strconv.AppendQuote(n.line, column.Name)
+		n.line = append(n.line, ':')
+		value := column.value(row)
+		switch {
+		case value == "":
+			n.line = append(n.line, "null"...)
+		case column.kind == kindInteger || column.kind == kindNumber || column.kind == kindBoolean:
+			n.line = append(n.line, value...)
+		default:
+			quoted, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			n.line = append(n.line, quoted...)
+		}
+	}
+	n.line = append(n.line, '}', '\n')
+	_, err := n.out.Write(n.line)
+	return err
+}
+
+func (n *ndjsonWriter) flush() error {
+	flushWriter(n.out)
+	return nil
+}
+
+func (n *ndjsonWriter) close() error {
+	return n.flush()
+}
+
+// Helper to flush the underlying writer if it supports it, e.g. the http response
+func flushWriter(w io.Writer) {
+	if f, ok := w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
+
+func formatDate(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Format("2006-01-02")
+}
+
+func yearsSinceObservation(row TableRow) string {
+	if !row.ObservationDate.Valid {
+		return ""
+	}
+	return strconv.FormatFloat(YearsSinceObservation(row.ObservationDate.Time), 'f', 1, 64)
+}
@@ -0,0 +1,158 @@
+package queries
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+)
+
+func TestExportCSV(t *testing.T) {
+	loadDemo()
+	/* More rows than a page and a name which needs quoting */
+	_, err := internal.DB.Exec(`INSERT INTO taxa (TaxonID, SynonymID, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus)
+		SELECT i, i, 'Apis "mellifera", ' || i, 'Animalia', 'Arthropoda', 'Insecta', 'Hymenoptera', 'Apidae', 'Apis' FROM range(1, 1501) t(i)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var b strings.Builder
+	count, err := Query{}.Export(context.Background(), internal.DB, &b, ExportColumns, "csv")
+	if err != nil || count != 1501 {
+		t.Fatalf("got %d %v, wanted %d", count, err, 1501)
+	}
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil || len(records) != 1502 {
+		t.Fatalf("got %d %v, wanted %d", len(records), err, 1502)
+	}
+	if records[0][3] != "CountryName" || len(records[1]) != len(ExportColumns) {
+		t.Errorf("got %v, wanted %d columns", records[0], len(ExportColumns))
+	}
+
+	columns, err := ParseExportColumns("scientificname, TaxonID")
+	if err != nil || len(columns) != 2 {
+		t.Fatalf("got %d %v, wanted %d", len(columns), err, 2)
+	}
+	b.Reset()
+	_, err = Query{SEARCH: "mellifera\", 1500", ORDER_BY: "name"}.Export(context.Background(), internal.DB, &b, columns, "tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if lines[0] != "ScientificName\tTaxonID" || lines[1] != "\"Apis \"\"mellifera\"\", 1500\"\t1500" {
+		t.Errorf("got %q, wanted %q", lines[:2], "\"Apis \"\"mellifera\"\", 1500\"\t1500")
+	}
+
+	if _, err = ParseExportColumns("TaxonID,Color"); err == nil {
+		t.Errorf("got %v, wanted error", err)
+	}
+	if _, _, err = ParseExportFormat("xml"); err == nil {
+		t.Errorf("got %v, wanted error", err)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	loadDemo()
+	var b strings.Builder
+	count, err := Query{SHOW_SYNONYMS: true}.Export(context.Background(), internal.DB, &b, ExportColumns, "ndjson")
+	if err != nil || count != 2 {
+		t.Fatalf("got %d %v, wanted %d", count, err, 2)
+	}
+	var row map[string]any
+	if err = json.Unmarshal([]byte(strings.Split(b.String(), "\n")[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if row["TaxonID"] != float64(4492208) || row["CountryName"] != "Austria" || row["isSynonym"] != false || row["LastFetch"] != nil {
+		t.Errorf("got %v, wanted typed values", row)
+	}
+	if years, ok := row["YearsSinceObservation"].(float64); !ok || years < 30 {
+		t.Errorf("got %v, wanted %s", row["YearsSinceObservation"], "more than 30 years")
+	}
+}
+
+func TestExportXLSX(t *testing.T) {
+	loadDemo()
+	var b bytes.Buffer
+	_, err := Query{}.Export(context.Background(), internal.DB, &b, ExportColumns, "xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, _ := f.Open()
+		sheet, _ := io.ReadAll(rc)
+		if !strings.Contains(string(sheet), "<t>Urocerus gigas</t>") || !strings.Contains(string(sheet), "<v>4492208</v>") {
+			t.Errorf("got %s, wanted %s", sheet, "Urocerus gigas")
+		}
+		return
+	}
+	t.Errorf("got %d files, wanted %s", len(r.File), "xl/worksheets/sheet1.xml")
+}
+
+func TestExportParquet(t *testing.T) {
+	loadDemo()
+	file := filepath.Join(t.TempDir(), "export.parquet")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, _ := ParseExportColumns("TaxonID,CountryName,CountryFlag,YearsSinceObservation")
+	count, err := Query{COUNTRY: "AT"}.Export(context.Background(), internal.DB, f, columns, "parquet")
+	f.Close()
+	if err != nil || count != 1 {
+		t.Fatalf("got %d %v, wanted %d", count, err, 1)
+	}
+
+	var taxonID int64
+	var name, flag string
+	var years float64
+	err = internal.DB.QueryRow("SELECT TaxonID, CountryName, CountryFlag, YearsSinceObservation FROM read_parquet(?)", file).Scan(&taxonID, &name, &flag, &years)
+	if err != nil || taxonID != 4492208 || name != "Austria" || flag != "🇦🇹" || years < 30 {
+		t.Errorf("got %d %s %s %f %v, wanted %s", taxonID, name, flag, years, err, "4492208 Austria")
+	}
+}
+
+func TestExportDwCA(t *testing.T) {
+	loadDemo()
+	var b bytes.Buffer
+	count, err := Query{SHOW_SYNONYMS: true, COUNTRY: "AT"}.Export(context.Background(), internal.DB, &b, nil, "dwca")
+	if err != nil || count != 1 {
+		t.Fatalf("got %d %v, wanted %d", count, err, 1)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, _ := f.Open()
+		content, _ := io.ReadAll(rc)
+		files[f.Name] = string(content)
+	}
+	if !strings.Contains(files["meta.xml"], `term="http://rs.tdwg.org/dwc/terms/eventDate"`) || !strings.Contains(files["eml.xml"], "country=AT") {
+		t.Errorf("got %v, wanted meta.xml and eml.xml", files)
+	}
+	lines := strings.Split(strings.TrimSpace(files["occurrence.txt"]), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "occurrenceID\tgbifID") {
+		t.Fatalf("got %q, wanted header and one occurrence", lines)
+	}
+	want := "https://www.gbif.org/occurrence/123456\t123456\tOccurrence\t1989-01-05\t1989-01-05\tAT\tAustria\t4492208\tUrocerus gigas"
+	if !strings.HasPrefix(lines[1], want) {
+		t.Errorf("got %q, wanted %q", lines[1], want)
+	}
+}
@@ -2,13 +2,18 @@ package queries
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/metrics"
 	sq "github.com/Masterminds/squirrel"
 )
 
@@ -16,11 +21,19 @@ type Query struct {
 	ORDER_BY      string
 	ORDER_DIR     string
 	SEARCH        string
-	COUNTRY       string
+	COUNTRY       string // Comma separated ISO codes
 	RANK          string
 	TAXA          string
 	PAGE          string
 	SHOW_SYNONYMS bool
+
+	OBSERVED_BEFORE string
+	OBSERVED_AFTER  string
+	MIN_YEARS       string
+	MAX_YEARS       string
+
+	EXCLUDE_COUNTRY string // Comma separated ISO codes
+	REGION          string // Comma separated region keys, see countries.Regions
 }
 
 type Counts struct {
@@ -34,6 +47,7 @@ type TableRow struct {
 	CountryCode      sql.NullString
 	CountryCodeClean string
 	CountryFlag      string
+	CountryName      string
 	LastFetch        sql.NullTime
 	ObservationID    sql.NullString
 	ObservationDate  sql.NullTime
@@ -54,6 +68,79 @@ type TableRows struct {
 	Rows []TableRow
 }
 
+type TaxonRow struct {
+	TaxonID        string
+	ScientificName string
+	TaxonKingdom   string
+	TaxonPhylum    string
+	TaxonClass     string
+	TaxonOrder     string
+	TaxonFamily    string
+	TaxonGenus     string
+	LastFetch      sql.NullTime
+	IsSynonym      bool
+	SynonymID      sql.NullString
+	SynonymName    sql.NullString
+}
+
+// Everything known about one taxon, observations and history belong to the accepted taxon if it is a synonym
+type TaxonDetail struct {
+	Taxon        TaxonRow
+	Accepted     *TaxonRow
+	Synonyms     []TaxonRow
+	Observations *TableRows
+	History      []HistoryRow
+}
+
+// Observations older than this are counted as long unseen on the country page
+const LongUnseenYears = 50
+
+type HistogramBucket struct {
+	Label string
+	Count int
+}
+
+type FamilyCount struct {
+	TaxonFamily string
+	Count       int
+}
+
+// Aggregated statistics of the latest observations in one country, synonyms are not counted
+type CountryProfile struct {
+	CountryCode      string
+	CountryFlag      string
+	CountryName      string
+	TaxaCount        int
+	LongUnseenCount  int
+	Histogram        []HistogramBucket
+	LongUnseenFamily []FamilyCount
+	Rediscoveries    []RediscoveryRow
+}
+
+type RediscoveryRow struct {
+	TaxonID                 string
+	ScientificName          sql.NullString
+	CountryCode             string
+	CountryFlag             string
+	CountryName             string
+	PreviousObservationID   string
+	PreviousObservationDate time.Time
+	ObservationID           string
+	ObservationDate         time.Time
+	GapYears                float64
+	DetectedAt              time.Time
+}
+
+type HistoryRow struct {
+	TaxonID                 string
+	CountryCode             string
+	PreviousObservationID   sql.NullString
+	PreviousObservationDate sql.NullTime
+	ObservationID           sql.NullString
+	ObservationDate         sql.NullTime
+	FetchedAt               time.Time
+}
+
 var _taxonRankMap = map[string]string{"kingdom": "TaxonKingdom", "phylum": "TaxonPhylum", "class": "TaxonClass", "order": "TaxonOrder", "family": "TaxonFamily"}
 
 var _selectArray = []string{"taxa.TaxonID", "ScientificName", "CountryCode", "LastFetch", "ObservationID", "ObservationDate", "TaxonKingdom", "TaxonPhylum", "TaxonClass", "TaxonOrder", "TaxonFamily", "isSynonym", "SynonymName", "SynonymID"}
@@ -101,6 +188,18 @@ func NewQuery(payload any) Query {
 					q.TAXA = val.(string)
 				case "PAGE":
 					q.PAGE = val.(string)
+				case "OBSERVED_BEFORE":
+					q.OBSERVED_BEFORE = val.(string)
+				case "OBSERVED_AFTER":
+					q.OBSERVED_AFTER = val.(string)
+				case "MIN_YEARS":
+					q.MIN_YEARS = val.(string)
+				case "MAX_YEARS":
+					q.MAX_YEARS = val.(string)
+				case "EXCLUDE_COUNTRY":
+					q.EXCLUDE_COUNTRY = val.(string)
+				case "REGION":
+					q.REGION = val.(string)
 				case "SHOW_SYNONYMS":
 					if reflect.TypeOf(val).Kind() == reflect.Bool {
 						q.SHOW_SYNONYMS = val.(bool)
@@ -116,6 +215,7 @@ func NewQuery(payload any) Query {
 
 // Get the counts of taxa and observations based on the query
 func (q Query) GetCounts(db *sql.DB) Counts {
+	defer metrics.ObserveQuery("GetCounts", time.Now())
 	var err error
 	var taxaCount int
 	var observationCount int
@@ -128,8 +228,16 @@ func (q Query) GetCounts(db *sql.DB) Counts {
 		slog.Error("Failed to get observation count", "error", err)
 	}
 
-	if q.COUNTRY != "" {
+	if q.COUNTRY != "" && q.REGION == "" && !strings.Contains(q.COUNTRY, ",") {
 		taxaCount = observationCount // There should be only one taxa per observation per country
+	} else if q.HasCountryFilter() || q.HasObservationFilter() {
+		taxaQuery := sq.Select("COUNT(DISTINCT taxa.TaxonID)").From("observations").InnerJoin("taxa ON observations.TaxonID = taxa.TaxonID")
+
+		createFilterQuery(&taxaQuery, q)
+		err = taxaQuery.RunWith(db).QueryRow().Scan(&taxaCount)
+		if err != nil {
+			slog.Error("Failed to get taxa count", "error", err)
+		}
 	} else {
 		taxaQuery := sq.Select("COUNT(*)").From("taxa").Where(sq.Eq{"isSynonym": false})
 
@@ -145,13 +253,30 @@ func (q Query) GetCounts(db *sql.DB) Counts {
 }
 
 // Get the table data based on the query
-func (q Query) GetTableData(db *sql.DB, increaseLimit ...bool) *TableRows {
-	query := sq.Select(_selectArray...).From("taxa").JoinClause("LEFT OUTER JOIN observations ON observations.TaxonID = taxa.SynonymID").Limit(DefaultPageLimit)
+func (q Query) GetTableData(db *sql.DB) *TableRows {
+	defer metrics.ObserveQuery("GetTableData", time.Now())
+	query := q.tableQuery().Limit(DefaultPageLimit)
 
-	if increaseLimit != nil && increaseLimit[0] {
-		query = query.Limit(IncreasedPageLimit)
+	if q.PAGE != "" {
+		page, err := strconv.ParseInt(q.PAGE, 0, 64)
+		if err != nil {
+			slog.Error("Failed to parse page", "error", err)
+		} else {
+			offset := DefaultPageLimit * (uint64(page) - 1)
+			query = query.Offset(offset)
+		}
 	}
 
+	return scanTableRows(query, db)
+}
+
+// Helper to build the sorted and filtered table query without paging, selects _selectArray if no columns are given
+func (q Query) tableQuery(columns ...string) sq.SelectBuilder {
+	if len(columns) == 0 {
+		columns = _selectArray
+	}
+	query := sq.Select(columns...).From("taxa").JoinClause("LEFT OUTER JOIN observations ON observations.TaxonID = taxa.SynonymID")
+
 	var direction string
 	if q.ORDER_DIR == "asc" {
 		direction = "ASC NULLS LAST"
@@ -167,106 +292,103 @@ func (q Query) GetTableData(db *sql.DB, increaseLimit ...bool) *TableRows {
 		query = query.OrderBy("LastFetch " + direction)
 	}
 
-	if q.PAGE != "" {
-		page, err := strconv.ParseInt(q.PAGE, 0, 64)
-		if err != nil {
-			slog.Error("Failed to parse page", "error", err)
-		} else {
-			offset := DefaultPageLimit * (uint64(page) - 1)
-			query = query.Offset(offset)
-		}
-	}
-
 	if !q.SHOW_SYNONYMS {
 		query = query.Where(sq.Or{sq.Eq{"isSynonym": false}})
 	}
 
 	createFilterQuery(&query, q)
+	return query
+}
 
+// Get the number of table rows for the query without paging, used for pagination metadata
+func (q Query) GetTableCount(db *sql.DB) int {
+	var count int
+	query := sq.Select("COUNT(*)").From("taxa").JoinClause("LEFT OUTER JOIN observations ON observations.TaxonID = taxa.SynonymID")
+	if !q.SHOW_SYNONYMS {
+		query = query.Where(sq.Eq{"isSynonym": false})
+	}
+	createFilterQuery(&query, q)
+	err := query.RunWith(db).QueryRow().Scan(&count)
+	if err != nil {
+		slog.Error("Failed to get table count", "error", err)
+	}
+	return count
+}
+
+// Get the latest observations per country of a single taxon, synonyms return the observations of their accepted taxon
+func GetTaxonObservations(db *sql.DB, taxonID string) *TableRows {
+	query := sq.Select(_selectArray...).From("taxa").
+		JoinClause("INNER JOIN observations ON observations.TaxonID = taxa.SynonymID").
+		Where(sq.Eq{"taxa.TaxonID": taxonID}).
+		OrderBy("ObservationDate ASC", "CountryCode ASC")
+	return scanTableRows(query, db)
+}
+
+// Helper to run a query selecting _selectArray and fill the derived display fields
+func scanTableRows(query sq.SelectBuilder, db *sql.DB) *TableRows {
 	rows, err := query.RunWith(db).Query()
 
 	var result = &TableRows{}
 	if err != nil {
-		slog.Error("Failed to get outdated observations", "error", err)
+		slog.Error("Failed to get table data", "error", err)
 		return result
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var row TableRow
-		err = rows.Scan(&row.TaxonID, &row.ScientificName, &row.CountryCode, &row.LastFetch, &row.ObservationID, &row.ObservationDate, &row.TaxonKingdom, &row.TaxonPhylum, &row.TaxonClass, &row.TaxonOrder, &row.TaxonFamily, &row.IsSynonym, &row.SynonymName, &row.SynonymID)
-
-		taxonFields := []string{row.TaxonKingdom, row.TaxonPhylum, row.TaxonClass, row.TaxonOrder, row.TaxonFamily}
-		row.Taxa = ""
-
-		for i, field := range taxonFields {
-			if field != "" {
-				row.Taxa += field
-			} else {
-				row.Taxa += "N/A"
-			}
-			if i != len(taxonFields)-1 {
-				row.Taxa += ", "
-			}
-		}
-
-		if row.ObservationDate.Valid {
-			row.ObservedDiff = calculateTimeSinceYears(row.ObservationDate.Time)
-		} else {
-			row.ObservedDiff = "N/A"
-		}
-
-		if row.CountryCode.Valid {
-			row.CountryCodeClean, row.CountryFlag = countryCodeToFlag(row.CountryCode.String)
-		}
-
+		row, err := scanTableRow(rows)
 		if err != nil {
-			slog.Error("Failed to get outdated observations", "error", err)
+			slog.Error("Failed to get table data", "error", err)
 		}
-
 		result.Rows = append(result.Rows, row)
 	}
 
 	return result
 }
 
-// Create a CSV string from the table data, this is used for exporting data
-func (rows *TableRows) CreateCSV() string {
-	var csv string
-	csv += strings.Join(_selectArray, ",") + "\n"
-	for _, row := range rows.Rows {
-		scientificName := ""
-		if row.ScientificName.Valid {
-			scientificName = row.ScientificName.String
-		}
-		countryCode := ""
-		if row.CountryCode.Valid {
-			countryCode = row.CountryCode.String
-		}
-		observationID := ""
-		if row.ObservationID.Valid {
-			observationID = row.ObservationID.String
-		}
-		observationDate := ""
-		if row.ObservationDate.Valid {
-			observationDate = row.ObservationDate.Time.Format("2006-01-02")
-		}
-		synonymName := ""
-		if row.SynonymName.Valid {
-			synonymName = row.SynonymName.String
+// Helper to scan the current row of a _selectArray query and fill the derived display fields
+func scanTableRow(rows *sql.Rows) (TableRow, error) {
+	var row TableRow
+	err := rows.Scan(&row.TaxonID, &row.ScientificName, &row.CountryCode, &row.LastFetch, &row.ObservationID, &row.ObservationDate, &row.TaxonKingdom, &row.TaxonPhylum, &row.TaxonClass, &row.TaxonOrder, &row.TaxonFamily, &row.IsSynonym, &row.SynonymName, &row.SynonymID)
+
+	taxonFields := []string{row.TaxonKingdom, row.TaxonPhylum, row.TaxonClass, row.TaxonOrder, row.TaxonFamily}
+	row.Taxa = ""
+
+	for i, field := range taxonFields {
+		if field != "" {
+			row.Taxa += field
+		} else {
+			row.Taxa += "N/A"
 		}
-		synonymID := ""
-		if row.SynonymID.Valid {
-			synonymID = row.SynonymID.String
+		if i != len(taxonFields)-1 {
+			row.Taxa += ", "
 		}
-		/* Needs to be same order as _selectArray */
-		csv += fmt.Sprintf(
-			"%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%t,%s,%s\n", row.TaxonID, scientificName, countryCode, row.LastFetch.Time.Format("2006-01-02"), observationID, observationDate, row.TaxonKingdom, row.TaxonPhylum, row.TaxonClass, row.TaxonOrder, row.TaxonFamily, row.IsSynonym, synonymName, synonymID)
 	}
-	return csv
+
+	if row.ObservationDate.Valid {
+		row.ObservedDiff = calculateTimeSinceYears(row.ObservationDate.Time)
+	} else {
+		row.ObservedDiff = "N/A"
+	}
+
+	if row.CountryCode.Valid {
+		row.CountryCodeClean, row.CountryFlag = countryCodeToFlag(row.CountryCode.String)
+		row.CountryName = countries.Name(row.CountryCodeClean)
+	}
+
+	return row, err
 }
 
 func calculateTimeSinceYears(t time.Time) string {
-	years := time.Since(t).Hours() / 24 / 365
-	return fmt.Sprintf("%.1f", years)
+	return fmt.Sprintf("%.1f", YearsSinceObservation(t))
+}
+
+// Days per year of all years since an observation, in SQL see _yearsSinceObservation
+const DaysPerYear = 365.25
+
+// Years since the observation date in whole days rounded to one decimal, the value shown in the table and API and compared by the years filters
+func YearsSinceObservation(t time.Time) float64 {
+	days := math.Floor(time.Since(t).Hours() / 24)
+	return math.Round(days/DaysPerYear*10) / 10
 }
 
 func countryCodeToFlag(x string) (country, flag string) {
@@ -282,12 +404,133 @@ func countryCodeToFlag(x string) (country, flag string) {
 	return x, " " + string('🇦'+rune(x[0])-'A') + string('🇦'+rune(x[1])-'A')
 }
 
+// HasCountryFilter reports whether the query filters on countries or regions
+func (q Query) HasCountryFilter() bool {
+	return q.COUNTRY != "" || q.EXCLUDE_COUNTRY != "" || q.REGION != ""
+}
+
+// Helper to get the included country codes, the union of the country list and the regions. Returns false without include filter.
+func (q Query) includedCountries() ([]string, bool, error) {
+	if q.COUNTRY == "" && q.REGION == "" {
+		return nil, false, nil
+	}
+	codes, err := countries.ParseCodes(q.COUNTRY)
+	if err != nil {
+		return nil, false, err
+	}
+	regionCodes, err := countries.ParseRegions(q.REGION)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, code := range regionCodes {
+		if !slices.Contains(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+	return codes, true, nil
+}
+
+// Validate returns an error for filter values which cannot be applied, handlers reject such queries with 400.
+// The filters of an invalid query match no rows instead of being dropped, dropping would widen the result.
+func (q Query) Validate() error {
+	if q.COUNTRY != "" {
+		if _, err := countries.ParseCodes(q.COUNTRY); err != nil {
+			return fmt.Errorf("country: %w", err)
+		}
+	}
+	if q.EXCLUDE_COUNTRY != "" {
+		if _, err := countries.ParseCodes(q.EXCLUDE_COUNTRY); err != nil {
+			return fmt.Errorf("exclude_country: %w", err)
+		}
+	}
+	if q.REGION != "" {
+		if _, err := countries.ParseRegions(q.REGION); err != nil {
+			return fmt.Errorf("region: %w", err)
+		}
+	}
+	if q.OBSERVED_BEFORE != "" {
+		if _, err := ParseObservedDate(q.OBSERVED_BEFORE); err != nil {
+			return fmt.Errorf("observed_before: %w", err)
+		}
+	}
+	if q.OBSERVED_AFTER != "" {
+		if _, err := ParseObservedDate(q.OBSERVED_AFTER); err != nil {
+			return fmt.Errorf("observed_after: %w", err)
+		}
+	}
+	if q.MIN_YEARS != "" {
+		if _, err := ParseYears(q.MIN_YEARS); err != nil {
+			return fmt.Errorf("min_years: %w", err)
+		}
+	}
+	if q.MAX_YEARS != "" {
+		if _, err := ParseYears(q.MAX_YEARS); err != nil {
+			return fmt.Errorf("max_years: %w", err)
+		}
+	}
+	return nil
+}
+
+// HasObservationFilter reports whether the query filters on the latest observation date
+func (q Query) HasObservationFilter() bool {
+	return q.OBSERVED_BEFORE != "" || q.OBSERVED_AFTER != "" || q.MIN_YEARS != "" || q.MAX_YEARS != ""
+}
+
+// Helper to remove filters which need the observations join, used for queries on the taxa table only
+func (q Query) taxaOnly() Query {
+	q.COUNTRY = ""
+	q.EXCLUDE_COUNTRY = ""
+	q.REGION = ""
+	q.OBSERVED_BEFORE = ""
+	q.OBSERVED_AFTER = ""
+	q.MIN_YEARS = ""
+	q.MAX_YEARS = ""
+	return q
+}
+
+// ParseObservedDate accepts a year "1950" or a date "1950-06-30" and returns the date, a year is the first of January
+func ParseObservedDate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	layout := "2006-01-02"
+	if len(value) == 4 {
+		layout = "2006"
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q, use YYYY or YYYY-MM-DD", value)
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// ParseYears accepts a non negative number of years since the latest observation
+func ParseYears(value string) (float64, error) {
+	years, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || years < 0 || math.IsNaN(years) || math.IsInf(years, 0) {
+		return 0, fmt.Errorf("invalid years %q, use a positive number", value)
+	}
+	return years, nil
+}
+
+var _yearsSinceObservation = fmt.Sprintf("date_diff('day', ObservationDate, current_date) / %g", DaysPerYear)
+
 func createFilterQuery(query *sq.SelectBuilder, q Query) {
 	if q.SEARCH != "" {
 		*query = query.Where(sq.ILike{"ScientificName": "%" + q.SEARCH + "%"})
 	}
-	if q.COUNTRY != "" {
-		*query = query.Where(sq.Eq{"CountryCode": strings.ToUpper(q.COUNTRY)})
+	/* Included countries are the union of the country list and regions, excluded countries only match observed rows */
+	if codes, ok, err := q.includedCountries(); err != nil {
+		slog.Warn("Invalid country filter, matching no rows", "error", err)
+		*query = query.Where("FALSE")
+	} else if ok {
+		*query = query.Where(sq.Eq{"CountryCode": codes})
+	}
+	if q.EXCLUDE_COUNTRY != "" {
+		if codes, err := countries.ParseCodes(q.EXCLUDE_COUNTRY); err != nil {
+			slog.Warn("Invalid exclude_country filter, matching no rows", "error", err)
+			*query = query.Where("FALSE")
+		} else if len(codes) > 0 {
+			*query = query.Where(sq.NotEq{"CountryCode": codes})
+		}
 	}
 
 	if q.RANK != "" {
@@ -298,6 +541,40 @@ func createFilterQuery(query *sq.SelectBuilder, q Query) {
 			}
 		}
 	}
+
+	/* Latest observation date, before is exclusive and after inclusive */
+	if q.OBSERVED_BEFORE != "" {
+		if date, err := ParseObservedDate(q.OBSERVED_BEFORE); err != nil {
+			slog.Warn("Invalid observed_before filter, matching no rows", "error", err)
+			*query = query.Where("FALSE")
+		} else {
+			*query = query.Where(sq.Lt{"ObservationDate": date})
+		}
+	}
+	if q.OBSERVED_AFTER != "" {
+		if date, err := ParseObservedDate(q.OBSERVED_AFTER); err != nil {
+			slog.Warn("Invalid observed_after filter, matching no rows", "error", err)
+			*query = query.Where("FALSE")
+		} else {
+			*query = query.Where(sq.GtOrEq{"ObservationDate": date})
+		}
+	}
+	if q.MIN_YEARS != "" {
+		if years, err := ParseYears(q.MIN_YEARS); err != nil {
+			slog.Warn("Invalid min_years filter, matching no rows", "error", err)
+			*query = query.Where("FALSE")
+		} else {
+			*query = query.Where("round("+_yearsSinceObservation+", 1) >= ?", years)
+		}
+	}
+	if q.MAX_YEARS != "" {
+		if years, err := ParseYears(q.MAX_YEARS); err != nil {
+			slog.Warn("Invalid max_years filter, matching no rows", "error", err)
+			*query = query.Where("FALSE")
+		} else {
+			*query = query.Where("round("+_yearsSinceObservation+", 1) <= ?", years)
+		}
+	}
 }
 
 // Get the value of a field, handling pointers
@@ -328,3 +605,308 @@ func GetCountFetchedLastTwelveMonths(db *sql.DB) int {
 	}
 	return count
 }
+
+// Get the changes of the latest observation of a taxon, newest first. An empty country code returns all countries.
+func GetObservationHistory(db *sql.DB, taxonID string, countryCode string) []HistoryRow {
+	query := sq.Select("TaxonID", "CountryCode", "PreviousObservationID", "PreviousObservationDate", "ObservationID", "ObservationDate", "FetchedAt").
+		From("observation_history").
+		Where(sq.Eq{"TaxonID": taxonID}).
+		OrderBy("FetchedAt DESC", "HistoryID DESC")
+	if countryCode != "" {
+		query = query.Where(sq.Eq{"CountryCode": strings.ToUpper(countryCode)})
+	}
+
+	var result []HistoryRow
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get observation history", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row HistoryRow
+		err = rows.Scan(&row.TaxonID, &row.CountryCode, &row.PreviousObservationID, &row.PreviousObservationDate, &row.ObservationID, &row.ObservationDate, &row.FetchedAt)
+		if err != nil {
+			slog.Error("Failed to get observation history", "error", err)
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// Get the persisted rediscoveries, most recently detected first. An empty country code returns all countries.
+func GetRediscoveries(db *sql.DB, countryCode string) []RediscoveryRow {
+	query := sq.Select("rediscoveries.TaxonID", "ScientificName", "CountryCode", "PreviousObservationID", "PreviousObservationDate", "ObservationID", "ObservationDate", "GapYears", "DetectedAt").
+		From("rediscoveries").
+		JoinClause("LEFT OUTER JOIN taxa ON taxa.TaxonID = rediscoveries.TaxonID").
+		OrderBy("DetectedAt DESC", "GapYears DESC").
+		Limit(IncreasedPageLimit)
+	if countryCode != "" {
+		query = query.Where(sq.Eq{"CountryCode": strings.ToUpper(countryCode)})
+	}
+
+	var result []RediscoveryRow
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get rediscoveries", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row RediscoveryRow
+		err = rows.Scan(&row.TaxonID, &row.ScientificName, &row.CountryCode, &row.PreviousObservationID, &row.PreviousObservationDate, &row.ObservationID, &row.ObservationDate, &row.GapYears, &row.DetectedAt)
+		if err != nil {
+			slog.Error("Failed to get rediscoveries", "error", err)
+			continue
+		}
+		_, row.CountryFlag = countryCodeToFlag(row.CountryCode)
+		row.CountryName = countries.Name(row.CountryCode)
+		result = append(result, row)
+	}
+	return result
+}
+
+var _taxonSelectArray = []string{"TaxonID", "ScientificName", "COALESCE(TaxonKingdom, '')", "COALESCE(TaxonPhylum, '')", "COALESCE(TaxonClass, '')", "COALESCE(TaxonOrder, '')", "COALESCE(TaxonFamily, '')", "COALESCE(TaxonGenus, '')", "LastFetch", "isSynonym", "SynonymID", "SynonymName"}
+
+// Get a page of taxa without observations sorted by name or last fetch, the API rejects the country and observation date filters and these are not applied here
+func (q Query) GetTaxa(db *sql.DB) []TaxonRow {
+	query := sq.Select(_taxonSelectArray...).From("taxa").Limit(DefaultPageLimit)
+
+	direction := "ASC NULLS LAST"
+	if q.ORDER_DIR != "asc" {
+		direction = "DESC NULLS LAST"
+	}
+	if q.ORDER_BY == "fetch" {
+		query = query.OrderBy("LastFetch "+direction, "TaxonID")
+	} else {
+		query = query.OrderBy("ScientificName "+direction, "TaxonID")
+	}
+
+	if q.PAGE != "" {
+		page, err := strconv.ParseInt(q.PAGE, 0, 64)
+		if err == nil && page > 0 {
+			query = query.Offset(DefaultPageLimit * (uint64(page) - 1))
+		}
+	}
+
+	q = q.taxaOnly()
+	if !q.SHOW_SYNONYMS {
+		query = query.Where(sq.Eq{"isSynonym": false})
+	}
+	createFilterQuery(&query, q)
+
+	var result []TaxonRow
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get taxa", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row, err := scanTaxonRow(rows)
+		if err != nil {
+			slog.Error("Failed to get taxa", "error", err)
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// Get the number of taxa for the query without paging, the country and observation date filters are not applied as in GetTaxa
+func (q Query) GetTaxaCount(db *sql.DB) int {
+	var count int
+	query := sq.Select("COUNT(*)").From("taxa")
+	q = q.taxaOnly()
+	if !q.SHOW_SYNONYMS {
+		query = query.Where(sq.Eq{"isSynonym": false})
+	}
+	createFilterQuery(&query, q)
+	err := query.RunWith(db).QueryRow().Scan(&count)
+	if err != nil {
+		slog.Error("Failed to get taxa count", "error", err)
+	}
+	return count
+}
+
+// Get a single taxon, returns sql.ErrNoRows if it does not exist
+func GetTaxon(db *sql.DB, taxonID string) (TaxonRow, error) {
+	row := sq.Select(_taxonSelectArray...).From("taxa").Where(sq.Eq{"TaxonID": taxonID}).RunWith(db).QueryRow()
+	return scanTaxonRow(row)
+}
+
+func scanTaxonRow(row sq.RowScanner) (TaxonRow, error) {
+	var t TaxonRow
+	err := row.Scan(&t.TaxonID, &t.ScientificName, &t.TaxonKingdom, &t.TaxonPhylum, &t.TaxonClass, &t.TaxonOrder, &t.TaxonFamily, &t.TaxonGenus, &t.LastFetch, &t.IsSynonym, &t.SynonymID, &t.SynonymName)
+	return t, err
+}
+
+// Get the detail of a taxon with its synonyms, latest observation per country and observation history.
+// Returns sql.ErrNoRows if the taxon does not exist.
+func GetTaxonDetail(db *sql.DB, taxonID string) (TaxonDetail, error) {
+	var detail TaxonDetail
+	var err error
+	detail.Taxon, err = GetTaxon(db, taxonID)
+	if err != nil {
+		return detail, err
+	}
+
+	acceptedID := detail.Taxon.TaxonID
+	if detail.Taxon.IsSynonym && detail.Taxon.SynonymID.Valid {
+		acceptedID = detail.Taxon.SynonymID.String
+		accepted, err := GetTaxon(db, acceptedID)
+		if err == nil {
+			detail.Accepted = &accepted
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return detail, err
+		}
+	}
+
+	rows, err := sq.Select(_taxonSelectArray...).From("taxa").
+		Where(sq.Eq{"SynonymID": acceptedID, "isSynonym": true}).
+		Where(sq.NotEq{"TaxonID": taxonID}).
+		OrderBy("ScientificName").
+		RunWith(db).Query()
+	if err != nil {
+		return detail, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		synonym, err := scanTaxonRow(rows)
+		if err != nil {
+			return detail, err
+		}
+		detail.Synonyms = append(detail.Synonyms, synonym)
+	}
+
+	detail.Observations = GetTaxonObservations(db, taxonID)
+	detail.History = GetObservationHistory(db, acceptedID, "")
+	return detail, nil
+}
+
+// Buckets of years since the latest observation, the upper bound is exclusive
+var _histogramBuckets = []struct {
+	Label    string
+	From, To int
+}{
+	{"< 10", 0, 10},
+	{"10 - 25", 10, 25},
+	{"25 - 50", 25, 50},
+	{"50 - 100", 50, 100},
+	{">= 100", 100, 100_000},
+}
+
+// Number of rediscoveries shown on the country page
+const countryRediscoveriesLimit = 10
+
+// Labels of the year classes used by the country histogram and the map legend
+func YearBucketLabels() []string {
+	labels := make([]string, len(_histogramBuckets))
+	for i, bucket := range _histogramBuckets {
+		labels[i] = bucket.Label
+	}
+	return labels
+}
+
+// Index of the year class for the given years since the latest observation
+func YearBucketIndex(years float64) int {
+	for i, bucket := range _histogramBuckets {
+		if years < float64(bucket.To) {
+			return i
+		}
+	}
+	return len(_histogramBuckets) - 1
+}
+
+// Aggregated latest observations of the filtered taxa in one country, synonyms are not counted
+type CountryStats struct {
+	CountryCode string
+	CountryName string
+	TaxaCount   int
+	MedianYears float64
+	MaxYears    float64
+}
+
+// Get the number of taxa and the median and maximum years since the latest observation per country for the query
+func (q Query) GetCountryStats(db *sql.DB) ([]CountryStats, error) {
+	query := sq.Select("CountryCode", "COUNT(DISTINCT taxa.TaxonID)", "median("+_yearsSinceObservation+")", "max("+_yearsSinceObservation+")").
+		From("observations").
+		InnerJoin("taxa ON observations.TaxonID = taxa.TaxonID").
+		Where(sq.Eq{"isSynonym": false}).
+		GroupBy("CountryCode").
+		OrderBy("CountryCode")
+	createFilterQuery(&query, q)
+
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []CountryStats
+	for rows.Next() {
+		var stats CountryStats
+		err = rows.Scan(&stats.CountryCode, &stats.TaxaCount, &stats.MedianYears, &stats.MaxYears)
+		if err != nil {
+			return nil, err
+		}
+		stats.CountryName = countries.Name(stats.CountryCode)
+		result = append(result, stats)
+	}
+	return result, rows.Err()
+}
+
+// Get the statistics for one country, unknown countries return an empty profile
+func GetCountryProfile(db *sql.DB, countryCode string) (CountryProfile, error) {
+	var profile CountryProfile
+	profile.CountryCode, profile.CountryFlag = countryCodeToFlag(strings.ToUpper(countryCode))
+	profile.CountryName = countries.Name(profile.CountryCode)
+
+	base := sq.Select().From("observations").
+		InnerJoin("taxa ON observations.TaxonID = taxa.TaxonID").
+		Where(sq.Eq{"CountryCode": profile.CountryCode, "isSynonym": false})
+
+	columns := []string{"COUNT(*)", "COUNT(*) FILTER (WHERE " + _yearsSinceObservation + " >= ?)"}
+	args := []any{LongUnseenYears}
+	for _, bucket := range _histogramBuckets {
+		columns = append(columns, "COUNT(*) FILTER (WHERE "+_yearsSinceObservation+" >= ? AND "+_yearsSinceObservation+" < ?)")
+		args = append(args, bucket.From, bucket.To)
+	}
+	counts := make([]int, len(_histogramBuckets))
+	dest := []any{&profile.TaxaCount, &profile.LongUnseenCount}
+	for i := range counts {
+		dest = append(dest, &counts[i])
+	}
+	err := base.Column(sq.Expr(strings.Join(columns, ", "), args...)).RunWith(db).QueryRow().Scan(dest...)
+	if err != nil {
+		return profile, err
+	}
+	for i, bucket := range _histogramBuckets {
+		profile.Histogram = append(profile.Histogram, HistogramBucket{Label: bucket.Label, Count: counts[i]})
+	}
+
+	rows, err := base.Columns("COALESCE(NULLIF(TaxonFamily, ''), 'N/A') AS Family", "COUNT(*) AS Count").
+		Where(_yearsSinceObservation+" >= ?", LongUnseenYears).
+		GroupBy("Family").
+		OrderBy("Count DESC", "Family").
+		Limit(10).
+		RunWith(db).Query()
+	if err != nil {
+		return profile, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var family FamilyCount
+		err = rows.Scan(&family.TaxonFamily, &family.Count)
+		if err != nil {
+			return profile, err
+		}
+		profile.LongUnseenFamily = append(profile.LongUnseenFamily, family)
+	}
+
+	profile.Rediscoveries = GetRediscoveries(db, profile.CountryCode)
+	if len(profile.Rediscoveries) > countryRediscoveriesLimit {
+		profile.Rediscoveries = profile.Rediscoveries[:countryRediscoveriesLimit]
+	}
+	return profile, nil
+}
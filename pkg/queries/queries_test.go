@@ -1,12 +1,18 @@
 package queries
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
 )
 
 // Demo data for testing, it is no synonym
@@ -55,6 +61,49 @@ func TestQuery(t *testing.T) {
 
 }
 
+func TestObservationFilter(t *testing.T) {
+	loadDemo()
+	/* Demo observation is from 1989-01-05 */
+	shown := fmt.Sprintf("%.1f", YearsSinceObservation(time.Date(1989, 1, 5, 0, 0, 0, 0, time.UTC)))
+	tests := []struct {
+		q    Query
+		want int
+	}{
+		{Query{OBSERVED_BEFORE: "1990"}, 1},
+		{Query{OBSERVED_BEFORE: "1989-01-05"}, 0},
+		{Query{OBSERVED_AFTER: "1989-01-05"}, 1},
+		{Query{OBSERVED_AFTER: "1990"}, 0},
+		{Query{OBSERVED_AFTER: "1980", OBSERVED_BEFORE: "1990"}, 1},
+		{Query{MIN_YEARS: "20"}, 1},
+		{Query{MIN_YEARS: "200"}, 0},
+		{Query{MAX_YEARS: "20"}, 0},
+		{Query{OBSERVED_BEFORE: "invalid"}, 0},
+		{Query{OBSERVED_AFTER: "1989-13-01"}, 0},
+		{Query{MIN_YEARS: shown, MAX_YEARS: shown}, 1},
+		{Query{MIN_YEARS: "-1"}, 0},
+		{Query{MAX_YEARS: "many"}, 0},
+	}
+	for _, test := range tests {
+		counts := test.q.GetCounts(internal.DB)
+		if counts.ObservationCount != test.want || counts.TaxaCount != test.want {
+			t.Errorf("got %d/%d, wanted %d for %+v", counts.ObservationCount, counts.TaxaCount, test.want, test.q)
+		}
+		table := test.q.GetTableData(internal.DB)
+		if len(table.Rows) != test.want {
+			t.Errorf("got %d, wanted %d for %+v", len(table.Rows), test.want, test.q)
+		}
+	}
+
+	for _, q := range []Query{{OBSERVED_BEFORE: "invalid"}, {OBSERVED_AFTER: "1989-13-01"}, {MIN_YEARS: "-1"}, {MAX_YEARS: "many"}} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("got no error, wanted invalid filter error for %+v", q)
+		}
+	}
+	if err := (Query{OBSERVED_BEFORE: "1990", OBSERVED_AFTER: "1980-06-30"}).Validate(); err != nil {
+		t.Errorf("got %v, wanted no error", err)
+	}
+}
+
 func TestNewQuery(t *testing.T) {
 	q := NewQuery(nil)
 	if q.ORDER_BY != "date" {
@@ -83,15 +132,276 @@ func TestConvertCSV(t *testing.T) {
 		SEARCH:        "Urocerus gigas",
 	}
 
-	table := q.GetTableData(internal.DB)
-	csv := table.CreateCSV()
+	var b strings.Builder
+	if _, err := q.Export(context.Background(), internal.DB, &b, ExportColumns, "csv"); err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	csv := b.String()
 	/* Header */
 	if !strings.Contains(csv, "TaxonID,ScientificName") {
 		t.Errorf("got %s, wanted %s", csv, "TaxonID,ScientificName")
 	}
 	/* Data */
-	if !strings.Contains(csv, "4492208,Urocerus gigas") {
-		t.Errorf("got %s, wanted %s", csv, "4492208,Urocerus gigas")
+	if !strings.Contains(csv, "4492208,Urocerus gigas,AT,Austria,") {
+		t.Errorf("got %s, wanted %s", csv, "4492208,Urocerus gigas,AT,Austria,")
+	}
+}
+
+func TestCountryFilter(t *testing.T) {
+	loadDemo()
+	_, err := internal.DB.Exec(`INSERT INTO observations (TaxonID, ObservationID, ObservationDateOriginal, ObservationDate, CountryCode) VALUES
+		(?, 2, '1990', '1990-01-01', 'DE'), (?, 3, '1995', '1995-01-01', 'CH'), (?, 4, '2000', '2000-01-01', 'BR')`, DemoTaxa[0], DemoTaxa[0], DemoTaxa[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		q            Query
+		observations int
+		taxa         int
+	}{
+		{"single", Query{COUNTRY: "at"}, 1, 1},
+		{"list", Query{COUNTRY: "AT, de"}, 2, 1},
+		{"exclude", Query{EXCLUDE_COUNTRY: "AT,DE"}, 2, 1},
+		{"region", Query{REGION: "eu"}, 2, 1},
+		{"regions", Query{REGION: "europe,south-america"}, 4, 1},
+		{"region and country", Query{REGION: "eu", COUNTRY: "BR"}, 3, 1},
+		{"region and exclude", Query{REGION: "europe", EXCLUDE_COUNTRY: "CH"}, 2, 1},
+		{"no match", Query{REGION: "oceania"}, 0, 0},
+		{"invalid matches nothing", Query{COUNTRY: "AT,XX"}, 0, 0},
+		{"invalid exclude matches nothing", Query{EXCLUDE_COUNTRY: "XX"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := tt.q.GetCounts(internal.DB)
+			if counts.ObservationCount != tt.observations || counts.TaxaCount != tt.taxa {
+				t.Errorf("got %d/%d, wanted %d/%d", counts.ObservationCount, counts.TaxaCount, tt.observations, tt.taxa)
+			}
+			if rows := tt.q.GetTableData(internal.DB).Rows; len(rows) != tt.observations {
+				t.Errorf("got %d, wanted %d", len(rows), tt.observations)
+			}
+		})
+	}
+
+	for _, q := range []Query{{COUNTRY: "AT,XX"}, {EXCLUDE_COUNTRY: "XX"}, {REGION: "atlantis"}} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("got no error, wanted invalid filter error for %+v", q)
+		}
+	}
+	if err := (Query{COUNTRY: "at", EXCLUDE_COUNTRY: "DE", REGION: "eu"}).Validate(); err != nil {
+		t.Errorf("got %v, wanted no error", err)
+	}
+
+	rows := Query{COUNTRY: "CH"}.GetTableData(internal.DB).Rows
+	if len(rows) != 1 || rows[0].CountryName != "Switzerland" {
+		t.Errorf("got %v, wanted %s", rows, "Switzerland")
+	}
+}
+
+func TestGetObservationHistory(t *testing.T) {
+	loadDemo()
+	_, err := internal.DB.Exec(`
+		INSERT INTO observation_history
+		(TaxonID, CountryCode, PreviousObservationID, PreviousObservationDate, ObservationID, ObservationDate, FetchedAt)
+		VALUES
+		(?, 'AT', NULL, NULL, 100, '1980-01-01', '2024-01-01'),
+		(?, 'AT', 100, '1980-01-01', 123456, '1989-01-05', '2024-02-01'),
+		(?, 'DE', NULL, NULL, 200, '1970-01-01', '2024-01-01')`, DemoTaxa[0], DemoTaxa[0], DemoTaxa[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	history := GetObservationHistory(internal.DB, DemoTaxa[0], "")
+	if len(history) != 3 {
+		t.Fatalf("got %d, wanted %d", len(history), 3)
+	}
+	if history[0].ObservationID.String != "123456" || history[0].PreviousObservationID.String != "100" {
+		t.Errorf("got %v, wanted %v", history[0].ObservationID.String, "123456")
+	}
+
+	history = GetObservationHistory(internal.DB, DemoTaxa[0], "de")
+	if len(history) != 1 {
+		t.Fatalf("got %d, wanted %d", len(history), 1)
+	}
+	if history[0].PreviousObservationID.Valid {
+		t.Errorf("got %v, wanted %v", history[0].PreviousObservationID, "NULL")
+	}
+}
+
+func TestGetRediscoveries(t *testing.T) {
+	loadDemo()
+	_, err := internal.DB.Exec(`
+		INSERT OR REPLACE INTO rediscoveries
+		(HistoryID, TaxonID, CountryCode, PreviousObservationID, PreviousObservationDate, ObservationID, ObservationDate, GapYears, DetectedAt)
+		VALUES (1, ?, 'AT', 100, '1900-01-01', 123456, '1989-01-05', 89.0, '2024-01-01')`, DemoTaxa[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rows := GetRediscoveries(internal.DB, "")
+	if len(rows) != 1 {
+		t.Fatalf("got %d, wanted %d", len(rows), 1)
+	}
+	if rows[0].ScientificName.String != "Urocerus gigas" {
+		t.Errorf("got %s, wanted %s", rows[0].ScientificName.String, "Urocerus gigas")
+	}
+	if rows[0].PreviousObservationID != "100" || rows[0].ObservationID != "123456" {
+		t.Errorf("got %s>%s, wanted %s", rows[0].PreviousObservationID, rows[0].ObservationID, "100>123456")
+	}
+}
+
+func TestGetTaxonDetail(t *testing.T) {
+	loadDemo()
+	detail, err := GetTaxonDetail(internal.DB, DemoTaxa[0])
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if detail.Accepted != nil {
+		t.Errorf("got %v, wanted %v", detail.Accepted, nil)
+	}
+	if len(detail.Synonyms) != 1 || detail.Synonyms[0].TaxonID != DemoSyn[0] {
+		t.Errorf("got %v, wanted %s", detail.Synonyms, DemoSyn[0])
+	}
+	if len(detail.Observations.Rows) != 1 || detail.Observations.Rows[0].CountryCodeClean != "AT" {
+		t.Errorf("got %v, wanted %s", detail.Observations.Rows, "AT")
+	}
+
+	/* Synonyms show the accepted taxon and its observations */
+	detail, err = GetTaxonDetail(internal.DB, DemoSyn[0])
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if detail.Accepted == nil || detail.Accepted.TaxonID != DemoTaxa[0] {
+		t.Errorf("got %v, wanted %s", detail.Accepted, DemoTaxa[0])
+	}
+	if len(detail.Synonyms) != 0 {
+		t.Errorf("got %d, wanted %d", len(detail.Synonyms), 0)
+	}
+	if len(detail.Observations.Rows) != 1 {
+		t.Errorf("got %d, wanted %d", len(detail.Observations.Rows), 1)
+	}
+
+	_, err = GetTaxonDetail(internal.DB, "1")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("got %v, wanted %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestGetCountryProfile(t *testing.T) {
+	loadDemo()
+	profile, err := GetCountryProfile(internal.DB, "at")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if profile.CountryCode != "AT" || profile.CountryFlag == "" {
+		t.Errorf("got %s %s, wanted %s", profile.CountryCode, profile.CountryFlag, "AT")
+	}
+	if profile.TaxaCount != 1 {
+		t.Errorf("got %d, wanted %d", profile.TaxaCount, 1)
+	}
+	/* Demo observation is from 1989 */
+	total := 0
+	for _, bucket := range profile.Histogram {
+		total += bucket.Count
+		if bucket.Label == "25 - 50" && bucket.Count != 1 {
+			t.Errorf("got %d, wanted %d", bucket.Count, 1)
+		}
+	}
+	if total != profile.TaxaCount {
+		t.Errorf("got %d, wanted %d", total, profile.TaxaCount)
+	}
+	if profile.LongUnseenCount != 0 || len(profile.LongUnseenFamily) != 0 {
+		t.Errorf("got %d %v, wanted %d", profile.LongUnseenCount, profile.LongUnseenFamily, 0)
+	}
+
+	profile, err = GetCountryProfile(internal.DB, "DE")
+	if err != nil || profile.TaxaCount != 0 {
+		t.Errorf("got %d %v, wanted %d", profile.TaxaCount, err, 0)
+	}
+
+	_, err = internal.DB.Exec(`INSERT INTO observations (TaxonID, ObservationID, ObservationDateOriginal, ObservationDate, CountryCode) VALUES (?, 1, '1900', '1900-01-01', 'IT')`, DemoTaxa[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile, err = GetCountryProfile(internal.DB, "IT")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if profile.LongUnseenCount != 1 || len(profile.LongUnseenFamily) != 1 || profile.LongUnseenFamily[0].TaxonFamily != "Siricidae" {
+		t.Errorf("got %d %v, wanted %s", profile.LongUnseenCount, profile.LongUnseenFamily, "Siricidae")
+	}
+}
+
+func TestGetCountryStats(t *testing.T) {
+	loadDemo()
+	stats, err := NewQuery(nil).GetCountryStats(internal.DB)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if len(stats) != 1 || stats[0].CountryCode != "AT" || stats[0].CountryName != "Austria" || stats[0].TaxaCount != 1 {
+		t.Fatalf("got %v, wanted one row for AT", stats)
+	}
+	/* Demo observation is from 1989 */
+	if stats[0].MedianYears < 25 || stats[0].MedianYears != stats[0].MaxYears {
+		t.Errorf("got %f %f, wanted equal years above 25", stats[0].MedianYears, stats[0].MaxYears)
+	}
+	if YearBucketIndex(stats[0].MaxYears) != 2 || YearBucketIndex(500) != len(YearBucketLabels())-1 {
+		t.Errorf("got %d, wanted %d", YearBucketIndex(stats[0].MaxYears), 2)
+	}
+
+	stats, _ = Query{EXCLUDE_COUNTRY: "AT"}.GetCountryStats(internal.DB)
+	if len(stats) != 0 {
+		t.Errorf("got %d, wanted %d", len(stats), 0)
+	}
+}
+
+func TestGetFetchAttempts(t *testing.T) {
+	loadDemo()
+	now := time.Now().UTC()
+	_, err := internal.DB.Exec("INSERT INTO fetch_runs (TriggeredBy, StartedAt) VALUES ('cron', ?)", now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = internal.DB.Exec(`INSERT INTO fetch_attempts (RunID, TaxonID, StartedAt, DurationMs, Requests, Countries, ErrorType, StatusCode) VALUES
+		(1, ?, ?, 10, 2, 1, NULL, NULL),
+		(1, ?, ?, 10, 1, 0, 'not_found', NULL),
+		(1, ?, ?, 10, 3, 0, 'upstream', 503),
+		(1, ?, ?, 10, 3, 0, 'upstream', 503)`,
+		DemoTaxa[0], now, DemoSyn[0], now, DemoTaxa[0], now, DemoTaxa[0], now.AddDate(0, 0, -10))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if runs := GetFetchRuns(internal.DB, 1); len(runs) != 1 || runs[0].FinishedAt.Valid || GetFetchRunCount(internal.DB) != 1 {
+		t.Errorf("got %v, wanted %s", runs, "one running run")
+	}
+	if attempts := GetFetchAttempts(internal.DB, "1", false); len(attempts) != 4 || attempts[0].ScientificName.String != "Urocerus gigas" {
+		t.Errorf("got %v, wanted %d attempts", attempts, 4)
+	}
+	/* Taxa without data on GBIF are no failures */
+	if failed := GetFetchAttempts(internal.DB, "", true); len(failed) != 2 || failed[0].AttemptID != 4 {
+		t.Errorf("got %v, wanted %d newest first", failed, 2)
+	}
+	counts := GetFetchErrorCounts(internal.DB, 7)
+	if len(counts) != 1 || counts[0].ErrorType != "upstream" || counts[0].StatusCode.Int64 != 503 || counts[0].Count != 1 {
+		t.Errorf("got %v, wanted %s", counts, "one upstream error in the past 7 days")
+	}
+}
+
+func TestGetRefreshProgress(t *testing.T) {
+	loadDemo()
+	progress := GetRefreshProgress(internal.DB, 6)
+	if progress.TotalTaxa != 1 || progress.NeverFetched != 1 || progress.DueTaxa() != 1 || progress.Percent() != 0 {
+		t.Errorf("got %+v, wanted %s", progress, "one never fetched taxon")
+	}
+	_, err := internal.DB.Exec("UPDATE taxa SET LastFetch = ?", time.Now().UTC())
+	if err != nil {
+		log.Fatal(err)
+	}
+	progress = GetRefreshProgress(internal.DB, 6)
+	if progress.FetchedTaxa != 1 || progress.Percent() != 100 {
+		t.Errorf("got %+v, wanted %s", progress, "one fetched taxon")
 	}
 }
 
@@ -99,14 +409,16 @@ func TestConvertCSV(t *testing.T) {
 func loadDemo() {
 	slog.SetLogLoggerLevel(slog.LevelError)
 	internal.Load()
-	internal.Migrations(internal.DB, internal.Config.ROOT)
+	if err := internal.Migrations(internal.DB, migrations.FS); err != nil {
+		log.Fatal(err)
+	}
 
 	_, err := internal.DB.Exec(`
 		INSERT OR REPLACE INTO taxa
 		(TaxonID, SynonymID, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus)
 		VALUES (` + strings.Join(DemoTaxa, ",") + ")")
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Database error", "error", err)
 		log.Fatal(err)
 	}
 	_, err = internal.DB.Exec(`
@@ -114,7 +426,7 @@ func loadDemo() {
 		(TaxonID, SynonymID, SynonymName, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus, isSynonym)
 		VALUES  (` + strings.Join(DemoSyn, ",") + ")")
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Database error", "error", err)
 		log.Fatal(err)
 	}
 
@@ -123,7 +435,7 @@ func loadDemo() {
 		(TaxonID, ObservationID, ObservationDateOriginal, ObservationDate, CountryCode)
 		VALUES (` + strings.Join(DemoObservation, ",") + ")")
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Database error", "error", err)
 		log.Fatal(err)
 	}
 }
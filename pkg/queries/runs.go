@@ -0,0 +1,188 @@
+package queries
+
+import (
+	"database/sql"
+	"log/slog"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// FetchRunRow is one cron batch, manual fetch or CLI run, FinishedAt is null while the run is going on
+type FetchRunRow struct {
+	RunID       int64
+	TriggeredBy string
+	StartedAt   time.Time
+	FinishedAt  sql.NullTime
+	Attempted   int
+	Succeeded   int
+	NotFound    int
+	Failed      int
+	Error       sql.NullString
+}
+
+// FetchAttemptRow is the fetch of one taxon in a run, ErrorType is null on success
+type FetchAttemptRow struct {
+	AttemptID      int64
+	RunID          int64
+	TaxonID        string
+	ScientificName sql.NullString
+	StartedAt      time.Time
+	DurationMs     int64
+	Requests       int
+	Countries      int
+	ErrorType      sql.NullString
+	StatusCode     sql.NullInt64
+	Error          sql.NullString
+}
+
+// RefreshProgress of the accepted taxa, fetched means within the staleness window of the refresh queue
+type RefreshProgress struct {
+	TotalTaxa    int
+	FetchedTaxa  int
+	NeverFetched int
+	StaleMonths  int
+}
+
+// Taxa which were never fetched or whose last fetch is outside the window
+func (p RefreshProgress) DueTaxa() int {
+	return p.TotalTaxa - p.FetchedTaxa
+}
+
+// Percentage of the accepted taxa fetched within the staleness window
+func (p RefreshProgress) Percent() float64 {
+	if p.TotalTaxa == 0 {
+		return 0
+	}
+	return float64(p.FetchedTaxa) / float64(p.TotalTaxa) * 100
+}
+
+// FetchErrorCount is the number of failed attempts with the same error type and GBIF status code
+type FetchErrorCount struct {
+	ErrorType  string
+	StatusCode sql.NullInt64
+	Count      int
+}
+
+var _fetchRunSelectArray = []string{"RunID", "TriggeredBy", "StartedAt", "FinishedAt", "Attempted", "Succeeded", "NotFound", "Failed", "Error"}
+
+func scanFetchRun(scanner sq.RowScanner) (FetchRunRow, error) {
+	var row FetchRunRow
+	err := scanner.Scan(&row.RunID, &row.TriggeredBy, &row.StartedAt, &row.FinishedAt, &row.Attempted, &row.Succeeded, &row.NotFound, &row.Failed, &row.Error)
+	return row, err
+}
+
+// Get a page of fetch runs, newest first
+func GetFetchRuns(db *sql.DB, page int) []FetchRunRow {
+	query := sq.Select(_fetchRunSelectArray...).From("fetch_runs").OrderBy("RunID DESC").Limit(DefaultPageLimit)
+	if page > 1 {
+		query = query.Offset(DefaultPageLimit * uint64(page-1))
+	}
+
+	var result []FetchRunRow
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get fetch runs", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row, err := scanFetchRun(rows)
+		if err != nil {
+			slog.Error("Failed to get fetch runs", "error", err)
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// Number of fetch runs, used for the pagination
+func GetFetchRunCount(db *sql.DB) int {
+	var count int
+	err := sq.Select("COUNT(*)").From("fetch_runs").RunWith(db).QueryRow().Scan(&count)
+	if err != nil {
+		slog.Error("Failed to get fetch run count", "error", err)
+	}
+	return count
+}
+
+// Get a single fetch run, returns sql.ErrNoRows if it does not exist
+func GetFetchRun(db *sql.DB, runID string) (FetchRunRow, error) {
+	return scanFetchRun(sq.Select(_fetchRunSelectArray...).From("fetch_runs").Where(sq.Eq{"RunID": runID}).RunWith(db).QueryRow())
+}
+
+// Get the attempts of a run in the order they were made, an empty run id returns the newest attempts of all runs.
+// With failedOnly the successful attempts and the taxa without data on GBIF are skipped.
+func GetFetchAttempts(db *sql.DB, runID string, failedOnly bool) []FetchAttemptRow {
+	query := sq.Select("AttemptID", "RunID", "fetch_attempts.TaxonID", "ScientificName", "StartedAt", "DurationMs", "Requests", "Countries", "ErrorType", "StatusCode", "Error").
+		From("fetch_attempts").
+		JoinClause("LEFT OUTER JOIN taxa ON taxa.TaxonID = fetch_attempts.TaxonID")
+	if runID != "" {
+		query = query.Where(sq.Eq{"RunID": runID}).OrderBy("AttemptID").Limit(IncreasedPageLimit)
+	} else {
+		query = query.OrderBy("AttemptID DESC").Limit(DefaultPageLimit)
+	}
+	if failedOnly {
+		query = query.Where(sq.And{sq.NotEq{"ErrorType": nil}, sq.NotEq{"ErrorType": "not_found"}})
+	}
+
+	var result []FetchAttemptRow
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get fetch attempts", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row FetchAttemptRow
+		err = rows.Scan(&row.AttemptID, &row.RunID, &row.TaxonID, &row.ScientificName, &row.StartedAt, &row.DurationMs, &row.Requests, &row.Countries, &row.ErrorType, &row.StatusCode, &row.Error)
+		if err != nil {
+			slog.Error("Failed to get fetch attempts", "error", err)
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// Get how many accepted taxa were fetched within the staleness window, the others are due for the refresh queue
+func GetRefreshProgress(db *sql.DB, staleMonths int) RefreshProgress {
+	progress := RefreshProgress{StaleMonths: staleMonths}
+	err := sq.Select("COUNT(*)", "COUNT(*) FILTER (WHERE LastFetch IS NULL)").
+		Column(sq.Expr("COUNT(*) FILTER (WHERE date_diff('month', LastFetch, CAST(? AS TIMESTAMP)) < ?)", time.Now().UTC(), staleMonths)).
+		From("taxa").
+		Where(sq.Eq{"isSynonym": false}).
+		RunWith(db).QueryRow().Scan(&progress.TotalTaxa, &progress.NeverFetched, &progress.FetchedTaxa)
+	if err != nil {
+		slog.Error("Failed to get refresh progress", "error", err)
+	}
+	return progress
+}
+
+// Get the failed attempts of the past days grouped by error type and GBIF status code, most frequent first
+func GetFetchErrorCounts(db *sql.DB, days int) []FetchErrorCount {
+	query := sq.Select("ErrorType", "StatusCode", "COUNT(*) AS Count").
+		From("fetch_attempts").
+		Where(sq.And{sq.NotEq{"ErrorType": nil}, sq.NotEq{"ErrorType": "not_found"}}).
+		Where("StartedAt >= CAST(? AS TIMESTAMP)", time.Now().UTC().AddDate(0, 0, -days)).
+		GroupBy("ErrorType", "StatusCode").
+		OrderBy("Count DESC", "ErrorType")
+
+	var result []FetchErrorCount
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		slog.Error("Failed to get fetch error counts", "error", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row FetchErrorCount
+		if err = rows.Scan(&row.ErrorType, &row.StatusCode, &row.Count); err != nil {
+			slog.Error("Failed to get fetch error counts", "error", err)
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package queries
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Rows of a single Excel worksheet including the header
+const xlsxMaxRows = 1_048_576
+
+// Minimal package parts of a workbook with a single sheet, the sheet itself is streamed
+var _xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="GBIF Extinct" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// Excel writer without external dependencies, strings and dates are inline strings and numbers are numeric cells
+type xlsxWriter struct {
+	zip     *zip.Writer
+	out     io.Writer
+	sheet   io.Writer
+	columns []ExportColumn
+	rows    int
+	cell    strings.Builder
+}
+
+func newXLSXWriter(w io.Writer, columns []ExportColumn) *xlsxWriter {
+	return &xlsxWriter{zip: zip.NewWriter(w), out: w, columns: columns}
+}
+
+func (x *xlsxWriter) header() error {
+	for _, part := range _xlsxParts {
+		f, err := x.zip.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	sheet, err := x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	x.sheet = sheet
+	_, err = io.WriteString(x.sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(x.columns))
+	for i, column := range x.columns {
+		names[i] = column.Name
+	}
+	return x.writeRow(names, nil)
+}
+
+func (x *xlsxWriter) row(row TableRow) error {
+	values := make([]string, len(x.columns))
+	for i, column := range x.columns {
+		values[i] = column.value(row)
+	}
+	return x.writeRow(values, x.columns)
+}
+
+// Helper to write one sheet row, without columns all values are written as strings
+func (x *xlsxWriter) writeRow(values []string, columns []ExportColumn) error {
+	x.rows++
+	if x.rows > xlsxMaxRows {
+		return errors.New("too many rows for an Excel sheet, use csv or parquet")
+	}
+	x.cell.Reset()
+	x.cell.WriteString("<row>")
+	for i, value := range values {
+		kind := kindString
+		if columns != nil {
+			kind = columns[i].kind
+		}
+		switch {
+		case value == "":
+			x.cell.WriteString("<c/>")
+		case kind == kindInteger || kind == kindNumber:
+			x.cell.WriteString("<c><v>" + value + "</v></c>")
+		case kind == kindBoolean:
+			b := "0"
+			if value == "true" {
+				b = "1"
+			}
+			x.cell.WriteString(`<c t="b"><v>` + b + "</v></c>")
+		default:
+			x.cell.WriteString(`<c t="inlineStr"><is><t>`)
+			xml.EscapeText(&x.cell, []byte(value))
+			x.cell.WriteString("</t></is></c>")
+		}
+	}
+	x.cell.WriteString("</row>")
+	_, err := io.WriteString(x.sheet, x.cell.String())
+	return err
+}
+
+func (x *xlsxWriter) flush() error {
+	if err := x.zip.Flush(); err != nil {
+		return err
+	}
+	flushWriter(x.out)
+	return nil
+}
+
+func (x *xlsxWriter) close() error {
+	if _, err := io.WriteString(x.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	if err := x.zip.Close(); err != nil {
+		return err
+	}
+	flushWriter(x.out)
+	return nil
+}
@@ -1,42 +1,56 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
 	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
 )
 
 func main() {
 	slog.Info("Starting cron")
 	internal.Load()
-
-	gbif.UpdateConfig(gbif.Config{UserAgentPrefix: internal.Config.UserAgentPrefix})
-
-	var ids []string
+	if err := internal.Migrations(internal.DB, internal.Files(migrations.FS, "migrations")); err != nil {
+		slog.Error("Failed to run migrations", "error", err)
+		os.Exit(1)
+	}
+	gbif.RediscoveryGapYears = internal.Config.RediscoveryGapYears
+	gbif.RefreshBatchSize = internal.Config.RefreshBatchSize
+	gbif.RefreshStaleMonths = internal.Config.RefreshStaleMonths
+
+	client := gbif.NewClient(gbif.Config{
+		UserAgentPrefix:   internal.Config.UserAgentPrefix,
+		BaseURL:           internal.Config.GbifApiUrl,
+		Timeout:           time.Duration(internal.Config.GbifTimeoutSec) * time.Second,
+		RetryAfterMax:     time.Duration(internal.Config.GbifRetryAfterMaxSec) * time.Second,
+		RequestsPerSecond: internal.Config.GbifRequestsPerSecond,
+		Workers:           internal.Config.GbifWorkers,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var result gbif.RefreshResult
+	var err error
 	if len(os.Args) > 1 {
-		ids = os.Args[1:]
+		ids := os.Args[1:]
 		slog.Info("Fetching observations for specific taxa", "taxa", ids)
+		result, err = client.RefreshTaxa(ctx, internal.DB, gbif.TriggerCLI, ids)
 	} else {
-		ids = gbif.GetOutdatedObservations(internal.DB)
-		slog.Info("Fetching observations for outdated taxa", "taxa", ids)
+		slog.Info("Fetching observations from the refresh queue", "batch", gbif.RefreshBatchSize)
+		result, err = client.DrainRefreshQueue(ctx, internal.DB, gbif.TriggerCLI)
 	}
-
-	var results = &[][]gbif.LatestObservation{}
-	for _, id := range ids {
-		gbif.UpdateLastFetchStatus(internal.DB, id)
-		res := gbif.FetchLatest(id)
-		if res == nil {
-			continue
-		}
-		*results = append(*results, *res)
+	if err != nil {
+		slog.Warn("Cron stopped early", "error", err)
 	}
-
-	if len(*results) == 0 {
-		slog.Info("No new observations found")
-		return
+	if err := result.Err(); err != nil {
+		slog.Error("Cron finished with failures", "failed", len(result.Failed), "error", err)
+		os.Exit(1)
 	}
-
-	gbif.SaveObservation(results, internal.DB)
 }
@@ -0,0 +1,77 @@
+// Export the latest observations with the same filters as the download, e.g. as Darwin Core Archive.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
+)
+
+// You can run this script with `go run scripts/export/export.go -format dwca -country AT -o extinct-at.zip`, without -o the file is written to stdout.
+func main() {
+	var q queries.Query
+	flag.StringVar(&q.SEARCH, "search", "", "Part of the scientific name")
+	flag.StringVar(&q.COUNTRY, "country", "", "Comma separated ISO 3166-1 alpha-2 country codes")
+	flag.StringVar(&q.EXCLUDE_COUNTRY, "exclude-country", "", "Comma separated country codes to exclude")
+	flag.StringVar(&q.REGION, "region", "", "Comma separated regions, e.g. europe or gbif-latin-america")
+	flag.StringVar(&q.RANK, "rank", "", "Taxonomic rank used with -taxa")
+	flag.StringVar(&q.TAXA, "taxa", "", "Prefix of the taxon name at the given rank")
+	flag.StringVar(&q.OBSERVED_BEFORE, "observed-before", "", "Latest observation before YYYY or YYYY-MM-DD")
+	flag.StringVar(&q.OBSERVED_AFTER, "observed-after", "", "Latest observation on or after YYYY or YYYY-MM-DD")
+	flag.StringVar(&q.MIN_YEARS, "min-years", "", "Minimum years since the latest observation")
+	flag.StringVar(&q.MAX_YEARS, "max-years", "", "Maximum years since the latest observation")
+	flag.BoolVar(&q.SHOW_SYNONYMS, "synonyms", false, "Include synonyms")
+	flag.StringVar(&q.ORDER_BY, "order-by", "date", "Sort column, date, name or fetch")
+	flag.StringVar(&q.ORDER_DIR, "order-dir", "asc", "Sort direction, asc or desc")
+	formatFlag := flag.String("format", "dwca", "Export format")
+	columnsFlag := flag.String("columns", "", "Comma separated column names, all by default")
+	output := flag.String("o", "", "Output file, stdout if empty")
+	flag.Parse()
+
+	if err := q.Validate(); err != nil {
+		slog.Error("Invalid filter", "error", err)
+		os.Exit(2)
+	}
+	format, _, err := queries.ParseExportFormat(*formatFlag)
+	if err != nil {
+		slog.Error("Invalid format", "error", err)
+		os.Exit(2)
+	}
+	columns, err := queries.ParseExportColumns(*columnsFlag)
+	if err != nil {
+		slog.Error("Invalid columns", "error", err)
+		os.Exit(2)
+	}
+
+	internal.Load()
+	defer internal.DB.Close()
+	if err := internal.Migrations(internal.DB, internal.Files(migrations.FS, "migrations")); err != nil {
+		slog.Error("Failed to run migrations", "error", err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			slog.Error("Failed to create output file", "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := q.Export(context.Background(), internal.DB, w, columns, format)
+	if err != nil {
+		slog.Error("Failed to export", "format", format, "rows", count, "error", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d rows as %s\n", count, format)
+}
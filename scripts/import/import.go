@@ -6,7 +6,7 @@ import (
 	"bufio"
 	"context"
 	"database/sql"
-	"fmt"
+	"database/sql/driver"
 	"log"
 	"log/slog"
 	"os"
@@ -14,7 +14,9 @@ import (
 	"time"
 
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
 	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
+	"github.com/marcboeker/go-duckdb"
 )
 
 var conn *sql.Conn
@@ -34,21 +36,23 @@ func main() {
 	}
 
 	internal.Load()
-	internal.Migrations(internal.DB, internal.Config.ROOT)
+	if err := internal.Migrations(internal.DB, internal.Files(migrations.FS, "migrations")); err != nil {
+		slog.Error("Failed to run migrations", "error", err)
+		return
+	}
+	gbif.RediscoveryGapYears = internal.Config.RediscoveryGapYears
 
 	var err error
 	conn, err = internal.DB.Conn(context.Background())
 	if err != nil {
-		slog.Error("Failed to connect to database", err)
+		slog.Error("Failed to connect to database", "error", err)
 		return
 	}
 	defer conn.Close()
 
 	clearImport()
 	importZIP(filePath)
-	removeOldObservations()
-	moveToObservations()
-	updateLastFetchStatus()
+	replaceObservations()
 	clearImport()
 	clearObservations()
 
@@ -60,7 +64,7 @@ func clearImport() {
 	slog.Info("Clearing import table")
 	_, err := conn.ExecContext(context.Background(), "DELETE FROM import")
 	if err != nil {
-		slog.Error("Failed to clear import table", err)
+		slog.Error("Failed to clear import table", "error", err)
 		log.Fatal(err)
 	}
 }
@@ -70,7 +74,7 @@ func clearObservations() {
 	slog.Info("Clearing observations table")
 	_, err := conn.ExecContext(context.Background(), "DELETE FROM observations WHERE TaxonID NOT IN (SELECT TaxonID FROM taxa)")
 	if err != nil {
-		slog.Error("Failed to clear observations table", err)
+		slog.Error("Failed to clear observations table", "error", err)
 		log.Fatal(err)
 	}
 }
@@ -81,7 +85,7 @@ func importZIP(filePath string) {
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		slog.Error("Failed to gbif zip file", err)
+		slog.Error("Failed to gbif zip file", "error", err)
 		log.Fatal(err)
 	}
 	defer file.Close()
@@ -89,28 +93,57 @@ func importZIP(filePath string) {
 	// read zip file
 	fileInfo, err := file.Stat()
 	if err != nil {
-		slog.Error("Failed to get file info", err)
+		slog.Error("Failed to get file info", "error", err)
 		log.Fatal(err)
 	}
 
 	reader, err := zip.NewReader(file, fileInfo.Size())
 	if err != nil {
-		slog.Error("Failed to read zip file", err)
+		slog.Error("Failed to read zip file", "error", err)
 		log.Fatal(err)
 	}
 
 	for _, zf := range reader.File {
 		zfFile, err := zf.Open()
 		if err != nil {
-			slog.Error("Failed to open file in zip", err)
+			slog.Error("Failed to open file in zip", "error", err)
 			continue
 		}
 		defer zfFile.Close()
 
 		scanner := bufio.NewScanner(zfFile)
-		var tempArray []string
+		count, err := appendFile(scanner)
+		if err != nil {
+			slog.Error("Database error", "error", err)
+			log.Fatal(err)
+		}
+		slog.Info("Inserted records", "file", zf.Name, "total", count)
+	}
+
+}
+
+// Load the rows of one export file with the DuckDB appender, which is far faster than INSERT statements for large exports.
+// The appender can't resolve conflicts, so rows go into a staging table first and are merged into the import table afterwards.
+func appendFile(scanner *bufio.Scanner) (int, error) {
+	ctx := context.Background()
+	_, err := conn.ExecContext(ctx, `CREATE OR REPLACE TEMP TABLE import_staging (
+		ObservationID VARCHAR,
+		TaxonID VARCHAR,
+		CountryCode VARCHAR,
+		ObservationDate VARCHAR,
+		ObservationDateOriginal VARCHAR
+	)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int = 0
+	err = conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", "import_staging")
+		if err != nil {
+			return err
+		}
 
-		var count int = 0
 		for scanner.Scan() {
 			var text = scanner.Text()
 			fields := strings.Split(text, "\t")
@@ -153,32 +186,68 @@ func importZIP(filePath string) {
 
 			cleanDate := gbif.CleanDate(data.ObservationDateOriginal)
 
-			insertString := fmt.Sprintf("('%s', '%s', '%s', '%s', '%s')", safeQuotes(data.ObservationID), safeQuotes(data.TaxonID), safeQuotes(data.CountryCode), safeQuotes(data.ObservationDateOriginal), safeQuotes(cleanDate))
-
-			tempArray = append(tempArray, insertString)
+			err := appender.AppendRow(data.ObservationID, data.TaxonID, data.CountryCode, cleanDate, data.ObservationDateOriginal)
+			if err != nil {
+				appender.Close()
+				return err
+			}
 			count++
 
-			if len(tempArray)%100_000 == 0 {
-				slog.Info("Inserting batch records", "count", len(tempArray), "total", count)
-				insert(&tempArray, "import")
+			if count%100_000 == 0 {
+				slog.Info("Appended batch records", "total", count)
 			}
 		}
 
 		if err := scanner.Err(); err != nil {
-			slog.Error("Failed to read backbone taxon file", err)
+			slog.Error("Failed to read backbone taxon file", "error", err)
 		}
 
-		if len(tempArray) > 0 {
-			slog.Info("Inserting last batch records", "count", len(tempArray), "total", count)
-			insert(&tempArray, "import")
-		}
+		return appender.Close()
+	})
+	if err != nil {
+		return count, err
+	}
+
+	/* Duplicated IDs keep the last row, like the INSERT OR REPLACE before */
+	_, err = conn.ExecContext(ctx, `
+		INSERT OR REPLACE INTO import (ObservationID, TaxonID, CountryCode, ObservationDate, ObservationDateOriginal)
+		SELECT DISTINCT ON (ObservationID) ObservationID, TaxonID, CountryCode, ObservationDate, ObservationDateOriginal
+		FROM import_staging
+		ORDER BY ObservationID, rowid DESC`)
+	if err != nil {
+		return count, err
+	}
+	_, err = conn.ExecContext(ctx, "DROP TABLE import_staging")
+	return count, err
+}
+
+// Replace the observations of the imported taxa in one transaction, the same steps as gbif.SaveTaxonObservations.
+// If a step fails nothing is changed, history and rediscoveries are only kept together with the new observations.
+func replaceObservations() {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Failed to start transaction", "error", err)
+		log.Fatal(err)
 	}
+	defer tx.Rollback()
 
+	fetchedAt := time.Now().UTC().Truncate(time.Microsecond)
+	recordHistory(tx, fetchedAt)
+	recordRediscoveries(tx, fetchedAt)
+	removeOldObservations(tx)
+	moveToObservations(tx)
+	updateLastFetchStatus(tx)
+
+	if err = tx.Commit(); err != nil {
+		slog.Error("Failed to commit imported observations", "error", err)
+		log.Fatal(err)
+	}
 }
 
-func updateLastFetchStatus() {
+func updateLastFetchStatus(tx *sql.Tx) {
 	now := time.Now().UTC().Format(time.RFC3339)
-	_, err := conn.ExecContext(context.Background(), "UPDATE taxa SET LastFetch = ? WHERE SynonymID IN (SELECT DISTINCT(TaxonID) FROM import) OR TaxonID IN (SELECT DISTINCT(TaxonID) FROM import)", now)
+	_, err := tx.ExecContext(context.Background(), "UPDATE taxa SET LastFetch = ? WHERE SynonymID IN (SELECT DISTINCT(TaxonID) FROM import) OR TaxonID IN (SELECT DISTINCT(TaxonID) FROM import)", now)
 	if err != nil {
 		slog.Error("Failed to update last fetch status", "error", err)
 		log.Fatal(err)
@@ -186,79 +255,79 @@ func updateLastFetchStatus() {
 }
 
 // Before moving imported data to observation table, remove old observations
-func removeOldObservations() {
-	_, err := conn.ExecContext(context.Background(), "DELETE FROM observations WHERE TaxonID IN (SELECT DISTINCT(TaxonID) FROM import)")
+func removeOldObservations(tx *sql.Tx) {
+	_, err := tx.ExecContext(context.Background(), "DELETE FROM observations WHERE TaxonID IN (SELECT DISTINCT(TaxonID) FROM import)")
 	if err != nil {
-		slog.Error("Failed to clear observations table", err)
+		slog.Error("Failed to clear observations table", "error", err)
 		log.Fatal(err)
 	}
 }
 
-// Move imported data to observation table
-func moveToObservations() {
-	stmt := `WITH tmp AS (
-				SELECT
-				TaxonID,
-				ObservationID,
-				CountryCode,
-				ObservationDateOriginal,
-				ObservationDate,
-    			row_number() OVER (PARTITION BY TaxonID, CountryCode ORDER  BY ObservationDate DESC) AS Row
-				FROM import 
-				ORDER BY ObservationDate
-			) SELECT ObservationID, TaxonID, CountryCode, ObservationDateOriginal, ObservationDate FROM tmp WHERE Row = 1;`
-	res, err := conn.QueryContext(context.Background(), stmt)
+// Latest imported observation per taxon and country
+const latestImportQuery = `SELECT ObservationID, TaxonID, CountryCode, ObservationDateOriginal, ObservationDate FROM (
+		SELECT
+		TaxonID,
+		ObservationID,
+		CountryCode,
+		ObservationDateOriginal,
+		ObservationDate,
+		row_number() OVER (PARTITION BY TaxonID, CountryCode ORDER BY ObservationDate DESC) AS Row
+		FROM import
+	) WHERE Row = 1`
+
+// Before replacing the observations, append every changed, new or vanished latest observation to the history
+func recordHistory(tx *sql.Tx, fetchedAt time.Time) {
+	stmt := `INSERT INTO observation_history
+			(TaxonID, CountryCode, PreviousObservationID, PreviousObservationDate, ObservationID, ObservationDate, FetchedAt)
+			WITH latest AS (` + latestImportQuery + `),
+			stored AS (
+				SELECT TaxonID, CountryCode, ObservationID, ObservationDate FROM observations
+				WHERE TaxonID IN (SELECT DISTINCT(TaxonID) FROM import)
+			)
+			SELECT
+			COALESCE(latest.TaxonID, stored.TaxonID),
+			COALESCE(latest.CountryCode, stored.CountryCode),
+			stored.ObservationID,
+			stored.ObservationDate,
+			latest.ObservationID,
+			latest.ObservationDate,
+			?
+			FROM latest FULL OUTER JOIN stored ON latest.TaxonID = stored.TaxonID AND latest.CountryCode = stored.CountryCode
+			WHERE latest.ObservationID IS DISTINCT FROM stored.ObservationID;`
+	res, err := tx.ExecContext(context.Background(), stmt, fetchedAt)
 	if err != nil {
-		slog.Error("Failed to get window of import table", err)
+		slog.Error("Failed to record observation history", "error", err)
 		log.Fatal(err)
 	}
-	defer res.Close()
-
-	var tempArray []string
-	var count int = 0
-	for res.Next() {
-		var data struct {
-			ObservationID           string
-			TaxonID                 string
-			CountryCode             string
-			ObservationDateOriginal string
-			ObservationDate         string
-		}
-		err := res.Scan(&data.ObservationID, &data.TaxonID, &data.CountryCode, &data.ObservationDateOriginal, &data.ObservationDate)
-		if err != nil {
-			slog.Error("Failed to scan data", err)
-			log.Fatal(err)
-		}
-
-		insertString := fmt.Sprintf("('%s', '%s', '%s', '%s', '%s')", safeQuotes(data.ObservationID), safeQuotes(data.TaxonID), safeQuotes(data.CountryCode), safeQuotes(data.ObservationDateOriginal), safeQuotes(data.ObservationDate))
-		tempArray = append(tempArray, insertString)
-		count++
-
-		if len(tempArray)%100000 == 0 {
-			slog.Info("Move batch records", "count", len(tempArray), "total", count)
-			insert(&tempArray, "observations")
-		}
-	}
-
-	if len(tempArray) > 0 {
-		slog.Info("Moving last batch records", "count", len(tempArray), "total", count)
-		insert(&tempArray, "observations")
+	count, err := res.RowsAffected()
+	if err != nil {
+		slog.Error("Failed to get affected rows", "error", err)
 	}
-
+	slog.Info("Recorded observation history", "total", count)
 }
 
-func safeQuotes(s string) string {
-	return strings.ReplaceAll(s, "'", "''")
+// Persist history entries of this import where the latest observation moved forward by more than the rediscovery gap
+func recordRediscoveries(tx *sql.Tx, fetchedAt time.Time) {
+	count, err := gbif.RecordRediscoveries(context.Background(), tx, fetchedAt, gbif.RediscoveryGapYears)
+	if err != nil {
+		slog.Error("Failed to record rediscoveries", "error", err)
+		log.Fatal(err)
+	}
+	slog.Info("Recorded rediscoveries", "total", count, "gapYears", gbif.RediscoveryGapYears)
 }
 
-func insert(tempArray *[]string, table string) {
-	_, err := conn.ExecContext(context.Background(), `
-		INSERT OR REPLACE INTO `+table+`
-		(ObservationID, TaxonID, CountryCode, ObservationDateOriginal, ObservationDate)
-		VALUES `+strings.Join(*tempArray, ","))
+// Move imported data to observation table, only the latest observation per taxon and country is kept
+func moveToObservations(tx *sql.Tx) {
+	stmt := `INSERT OR REPLACE INTO observations
+			(ObservationID, TaxonID, CountryCode, ObservationDateOriginal, ObservationDate) ` + latestImportQuery + ";"
+	res, err := tx.ExecContext(context.Background(), stmt)
 	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Failed to move import table to observations", "error", err)
 		log.Fatal(err)
 	}
-	*tempArray = nil
+	count, err := res.RowsAffected()
+	if err != nil {
+		slog.Error("Failed to get affected rows", "error", err)
+	}
+	slog.Info("Moved records to observations", "total", count)
 }
@@ -0,0 +1,60 @@
+// Show the status of the database migrations or apply the pending ones.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
+)
+
+// You can run this script with `go run scripts/migrate/migrate.go [status|up]`, the default is status.
+func main() {
+	command := "status"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	internal.Load()
+	defer internal.DB.Close()
+	ctx := context.Background()
+
+	switch command {
+	case "status":
+		status, err := internal.GetMigrationStatus(ctx, internal.DB, internal.Files(migrations.FS, "migrations"))
+		if err != nil {
+			slog.Error("Failed to get migration status", "error", err)
+			os.Exit(1)
+		}
+		pending := 0
+		for _, s := range status {
+			state := "pending"
+			if s.Applied() {
+				state = "applied " + s.AppliedAt.Time.Format("2006-01-02 15:04:05")
+			} else {
+				pending++
+			}
+			if s.Query == "" && s.Applied() {
+				state += " (file missing)"
+			}
+			fmt.Printf("%03d  %-30s %s\n", s.Version, s.Name, state)
+		}
+		fmt.Printf("%d migrations, %d pending\n", len(status), pending)
+	case "up":
+		applied, err := internal.Migrate(ctx, internal.DB, internal.Files(migrations.FS, "migrations"))
+		for _, m := range applied {
+			fmt.Printf("applied %03d-%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			slog.Error("Failed to apply migrations", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d migrations applied\n", len(applied))
+	default:
+		slog.Error("Unknown command, use status or up", "command", command)
+		os.Exit(2)
+	}
+}
@@ -7,12 +7,12 @@ import (
 	"bufio"
 	"context"
 	"database/sql"
-	"fmt"
 	"log/slog"
 	"os"
 	"strings"
 
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
 )
 
 var conn *sql.Conn
@@ -22,12 +22,15 @@ var conn *sql.Conn
 func main() {
 	slog.Info("Starting mutation")
 	internal.Load()
-	internal.Migrations(internal.DB, internal.Config.ROOT)
+	if err := internal.Migrations(internal.DB, internal.Files(migrations.FS, "migrations")); err != nil {
+		slog.Error("Failed to run migrations", "error", err)
+		return
+	}
 
 	var err error
 	conn, err = internal.DB.Conn(context.Background())
 	if err != nil {
-		slog.Error("Failed to connect to database", err)
+		slog.Error("Failed to connect to database", "error", err)
 		return
 	}
 	defer conn.Close()
@@ -75,7 +78,7 @@ func populateSynonyms() {
 	slog.Info("Populating synonyms table", "file", internal.Config.TaxonSimplePath)
 	file, err := os.Open(internal.Config.TaxonSimplePath)
 	if err != nil {
-		slog.Error("Failed to open simple file", err)
+		slog.Error("Failed to open simple file", "error", err)
 		return
 	}
 	defer file.Close()
@@ -122,7 +125,7 @@ func populateSynonyms() {
 			/* If there is no parent in our database, we delete the taxon. As the parent is probably not species level */
 			_, err = conn.ExecContext(context.Background(), `DELETE FROM taxa WHERE TaxonID = ?`, backbone.ID)
 			if err != nil {
-				slog.Error("Database delete error", err)
+				slog.Error("Database delete error", "error", err)
 			}
 			continue
 		}
@@ -135,7 +138,7 @@ func populateSynonyms() {
 			WHERE TaxonID = ?
 		`, backbone.ParentKey, parentName, true, backbone.ID)
 		if err != nil {
-			slog.Error("Database update error", err)
+			slog.Error("Database update error", "error", err)
 		}
 		count++
 
@@ -145,7 +148,7 @@ func populateSynonyms() {
 	}
 
 	if err := scanner.Err(); err != nil {
-		slog.Error("Failed to read backbone taxon file", err)
+		slog.Error("Failed to read backbone taxon file", "error", err)
 	}
 }
 
@@ -183,14 +186,15 @@ func populateTaxa() {
 	slog.Info("Populating taxa table", "file", internal.Config.TaxonBackbonePath)
 	file, err := os.Open(internal.Config.TaxonBackbonePath)
 	if err != nil {
-		slog.Error("Failed to open backbone taxon file", err)
+		slog.Error("Failed to open backbone taxon file", "error", err)
 		return
 	}
 	defer file.Close()
 
 	var count int = 0
 	scanner := bufio.NewScanner(file)
-	var tempArray []string
+	/* The SynonymID is primarily used for connection to the observation table, if the taxon itself is no synonym the TaxonID will be equal to the SynonymID */
+	writer := internal.NewBulkWriter(conn, "taxa", []string{"TaxonID", "SynonymID", "ScientificName", "TaxonKingdom", "TaxonPhylum", "TaxonClass", "TaxonOrder", "TaxonFamily", "TaxonGenus"}, internal.ConflictReplace).WithBatchSize(5000)
 
 	for scanner.Scan() {
 		count++
@@ -209,37 +213,22 @@ func populateTaxa() {
 			continue
 		}
 
-		insertString := fmt.Sprintf("(%s, %s, '%s', '%s', '%s', '%s', '%s', '%s', '%s')", fields[0], fields[0], safeQuotes(fields[7]), safeQuotes(fields[17]), safeQuotes(fields[18]), safeQuotes(fields[19]), safeQuotes(fields[20]), safeQuotes(fields[21]), safeQuotes(fields[22]))
-		tempArray = append(tempArray, insertString)
-
-		if len(tempArray)%5000 == 0 {
-			slog.Info("Inserting batch records", "count", len(tempArray))
-			insert(&tempArray)
+		err := writer.Add(context.Background(), fields[0], fields[0], fields[7], fields[17], fields[18], fields[19], fields[20], fields[21], fields[22])
+		if err != nil {
+			slog.Error("Database error", "error", err)
+		}
+		if writer.Pending() == 0 {
+			slog.Info("Inserted batch records", "total", writer.Total())
 		}
 	}
 
-	if len(tempArray) > 0 {
-		slog.Info("Inserting last batch records", "count", len(tempArray))
-		insert(&tempArray)
+	slog.Info("Inserting last batch records", "count", writer.Pending())
+	err = writer.Flush(context.Background())
+	if err != nil {
+		slog.Error("Database error", "error", err)
 	}
 
 	if err := scanner.Err(); err != nil {
-		slog.Error("Failed to read backbone taxon file", err)
-	}
-}
-
-func safeQuotes(s string) string {
-	return strings.ReplaceAll(s, "'", "''")
-}
-
-func insert(tempArray *[]string) {
-	/* The SynonymID is primarily used for connection to the observation table, if the taxon itself is no synonym the TaxonID will be equal to the SynonymID */
-	_, err := conn.ExecContext(context.Background(), `
-		INSERT OR REPLACE INTO taxa
-		(TaxonID, SynonymID, ScientificName, TaxonKingdom, TaxonPhylum, TaxonClass, TaxonOrder, TaxonFamily, TaxonGenus)
-		VALUES `+strings.Join(*tempArray, ","))
-	if err != nil {
-		slog.Error("Database error", err)
+		slog.Error("Failed to read backbone taxon file", "error", err)
 	}
-	*tempArray = nil
 }
@@ -2,66 +2,137 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/HannesOberreiter/gbif-extinct/assets"
 	"github.com/HannesOberreiter/gbif-extinct/components"
 	"github.com/HannesOberreiter/gbif-extinct/internal"
+	"github.com/HannesOberreiter/gbif-extinct/migrations"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/api"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/countries"
 	"github.com/HannesOberreiter/gbif-extinct/pkg/gbif"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/maps"
+	"github.com/HannesOberreiter/gbif-extinct/pkg/metrics"
 	"github.com/HannesOberreiter/gbif-extinct/pkg/queries"
 	"github.com/a-h/templ"
 	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
 )
 
 var scheduler gocron.Scheduler
+var gbifClient *gbif.Client
+var fetchJobs *gbif.FetchJobs
+var demand = gbif.NewDemandRecorder()
 var cacheBuster = time.Now().Unix()
 
 func main() {
 
 	e := echo.New()
 
+	/* Init Packages */
+	internal.Load()
+	ipExtractor, err := newIPExtractor(internal.Config.TrustedProxies)
+	if err != nil {
+		slog.Error("Invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+	e.IPExtractor = ipExtractor
+	// Update the database schema to the latest version
+	if err := internal.Migrations(internal.DB, internal.Files(migrations.FS, "migrations")); err != nil {
+		slog.Error("Failed to run migrations", "error", err)
+		os.Exit(1)
+	}
+	gbifClient = gbif.NewClient(gbif.Config{
+		UserAgentPrefix:   internal.Config.UserAgentPrefix,
+		BaseURL:           internal.Config.GbifApiUrl,
+		Timeout:           time.Duration(internal.Config.GbifTimeoutSec) * time.Second,
+		RetryAfterMax:     time.Duration(internal.Config.GbifRetryAfterMaxSec) * time.Second,
+		RequestsPerSecond: internal.Config.GbifRequestsPerSecond,
+		Workers:           internal.Config.GbifWorkers,
+	})
+	gbif.RediscoveryGapYears = internal.Config.RediscoveryGapYears
+	gbif.RefreshBatchSize = internal.Config.RefreshBatchSize
+	gbif.RefreshStaleMonths = internal.Config.RefreshStaleMonths
+	gbif.FetchCooldown = time.Duration(internal.Config.FetchCooldownMin) * time.Minute
+	gbif.MaxFetchJobs = internal.Config.FetchMaxConcurrent
+	components.RenderAbout(internal.Files(readme, "."))
+	metrics.RegisterFetchedTaxa(func() int { return queries.GetCountFetchedLastTwelveMonths(internal.DB) })
+
 	/* Middleware */
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(metrics.Middleware())
 
 	/* Routes */
 	e.GET("/", index)
 	e.GET("/about", about)
+	e.GET("/taxon/:id", taxon)
+	e.GET("/country/:code", country)
+	e.GET("/rediscoveries", rediscoveries)
+	e.GET("/rediscoveries.json", rediscoveriesJSON)
+	e.GET("/map", mapPage)
+	e.GET("/map.svg", mapSVG)
+	e.GET("/map.geojson", mapGeoJSON)
+	e.GET("/admin", admin)
+	e.GET("/admin/runs/:id", adminRun)
 	e.GET("/table", table)
-	e.GET("/fetch", fetch)
+	e.GET("/fetch", fetch, fetchRateLimiter(internal.Config.FetchRequestsPerMin))
+	e.GET("/fetch/:id", fetchStatus)
+	e.GET("/fetch/:id/events", fetchEvents)
 	e.GET("/download", download)
-	e.File("/favicon.ico", "./assets/favicon.png")
-	e.Static("/assets", "./assets")
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", readyz)
+	e.GET("/metrics", metrics.Handler())
+	api.Register(e)
+	e.HTTPErrorHandler = api.ErrorHandler(e.DefaultHTTPErrorHandler)
 
 	/* Middleware */
 	e.Use(middleware.TimeoutWithConfig(middleware.TimeoutConfig{
+		// The timeout handler buffers the whole response, downloads and fetch events are streamed instead
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/download" || c.Path() == "/fetch/:id/events"
+		},
 		OnTimeoutRouteErrorHandler: func(err error, c echo.Context) {
 			slog.Warn("Timeout", "path", c.Path())
 		},
 		Timeout: 15 * 60 * time.Second,
 	}))
 
-	/* Init Packages */
-	internal.Load()
-	internal.Migrations(internal.DB, internal.Config.ROOT) // Update the database schema to the latest version
-	gbif.UpdateConfig(gbif.Config{UserAgentPrefix: internal.Config.UserAgentPrefix})
-	components.RenderAbout()
+	/* Static files, embedded into the binary unless DEV_DIR is set */
+	assetFiles := internal.Files(assets.FS, "assets")
+	e.FileFS("/favicon.ico", "icons/favicon-32x32.png", assetFiles)
+	e.StaticFS("/assets", assetFiles)
+
+	/* Canceled on SIGTERM, stops in-flight GBIF work of the cron job and requests */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fetchJobs = gbif.NewFetchJobs(ctx, gbifClient, internal.DB)
 
 	/* Start cron scheduler */
-	setupScheduler()
+	setupScheduler(ctx)
 	if scheduler != nil {
 		scheduler.Start()
 	}
 
 	/* Start http server */
+	e.Server.BaseContext = func(_ net.Listener) context.Context { return ctx }
 	go func() {
 		if err := e.Start(":1323"); err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("shutting down the server")
@@ -69,18 +140,17 @@ func main() {
 	}()
 
 	/* Graceful shutdown */
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
-
 	<-ctx.Done()
 	slog.Info("Server shutdown")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := scheduler.Shutdown(); err != nil {
-		e.Logger.Fatal("Failed to stop scheduler", "error", err)
+	if scheduler != nil {
+		if err := scheduler.Shutdown(); err != nil {
+			e.Logger.Fatal("Failed to stop scheduler", "error", err)
+		}
+		slog.Info("Scheduler stopped")
 	}
-	slog.Info("Scheduler stopped")
-	if err := e.Shutdown(ctx); err != nil {
+	if err := e.Shutdown(shutdownCtx); err != nil {
 		e.Logger.Fatal("Failed to stop server", "error", err)
 	}
 	slog.Info("Server stopped")
@@ -100,11 +170,22 @@ type Payload struct {
 	TAXA          *string `query:"taxa"`
 	PAGE          *string `query:"page"`
 	SHOW_SYNONYMS *bool   `query:"show_synonyms"`
+
+	OBSERVED_BEFORE *string `query:"observed_before"`
+	OBSERVED_AFTER  *string `query:"observed_after"`
+	MIN_YEARS       *string `query:"min_years"`
+	MAX_YEARS       *string `query:"max_years"`
+
+	EXCLUDE_COUNTRY *string `query:"exclude_country"`
+	REGION          *string `query:"region"`
 }
 
 /* Pages */
 func index(c echo.Context) error {
-	q := buildQuery(c)
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
 	counts := q.GetCounts(internal.DB)
 
 	return render(c,
@@ -116,15 +197,204 @@ func index(c echo.Context) error {
 func about(c echo.Context) error {
 	countTaxa := queries.GetCountTotalTaxa(internal.DB)
 	countLastFetched := queries.GetCountFetchedLastTwelveMonths(internal.DB)
+	queueLength := gbif.GetRefreshQueueLength(c.Request().Context(), internal.DB)
 
 	return render(c,
 		http.StatusAccepted,
-		components.PageAbout(countTaxa, countLastFetched, cacheBuster))
+		components.PageAbout(countTaxa, countLastFetched, queueLength, cacheBuster))
+}
+
+func taxon(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return c.String(http.StatusBadRequest, "Taxon id must be a GBIF taxon key")
+	}
+	detail, err := queries.GetTaxonDetail(internal.DB, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Taxon not found")
+	}
+	if err != nil {
+		slog.Error("Failed to get taxon detail", "taxonID", id, "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get taxon")
+	}
+	if err = demand.Record(c.Request().Context(), internal.DB, id, c.RealIP()); err != nil {
+		slog.Warn("Failed to record refresh demand", "taxonID", id, "error", err)
+	}
+
+	return render(c,
+		http.StatusAccepted,
+		components.PageTaxon(detail, cacheBuster))
+}
+
+// Country profile, the upper case code is the permalink
+func country(c echo.Context) error {
+	code := c.Param("code")
+	if len(code) != 2 || strings.ContainsFunc(code, func(r rune) bool { return !unicode.IsLetter(r) || r > unicode.MaxASCII }) {
+		return c.String(http.StatusBadRequest, "Country must be a 2-letter ISO code")
+	}
+	if upper := strings.ToUpper(code); upper != code {
+		return c.Redirect(http.StatusMovedPermanently, "/country/"+upper)
+	}
+	if _, ok := countries.Get(code); !ok {
+		return c.String(http.StatusNotFound, "Country not found")
+	}
+
+	profile, err := queries.GetCountryProfile(internal.DB, code)
+	if err != nil {
+		slog.Error("Failed to get country profile", "country", code, "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get country")
+	}
+
+	return render(c,
+		http.StatusAccepted,
+		components.PageCountry(profile, cacheBuster))
+}
+
+func rediscoveries(c echo.Context) error {
+	return render(c,
+		http.StatusAccepted,
+		components.PageRediscoveries(queries.GetRediscoveries(internal.DB, ""), gbif.RediscoveryGapYears, cacheBuster))
+}
+
+type Rediscovery struct {
+	TaxonID                 string  `json:"taxonID"`
+	ScientificName          string  `json:"scientificName"`
+	CountryCode             string  `json:"countryCode"`
+	CountryName             string  `json:"countryName"`
+	PreviousObservationDate string  `json:"previousObservationDate"`
+	PreviousObservationURL  string  `json:"previousObservationURL"`
+	ObservationDate         string  `json:"observationDate"`
+	ObservationURL          string  `json:"observationURL"`
+	GapYears                float64 `json:"gapYears"`
+	DetectedAt              string  `json:"detectedAt"`
+}
+
+// Rediscoveries as JSON, dates are formatted the same as on the page
+func rediscoveriesJSON(c echo.Context) error {
+	rows := queries.GetRediscoveries(internal.DB, "")
+	result := make([]Rediscovery, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, Rediscovery{
+			TaxonID:                 row.TaxonID,
+			ScientificName:          row.ScientificName.String,
+			CountryCode:             row.CountryCode,
+			CountryName:             row.CountryName,
+			PreviousObservationDate: row.PreviousObservationDate.Format("2006-01-02"),
+			PreviousObservationURL:  gbif.OccurrenceURL + row.PreviousObservationID,
+			ObservationDate:         row.ObservationDate.Format("2006-01-02"),
+			ObservationURL:          gbif.OccurrenceURL + row.ObservationID,
+			GapYears:                math.Round(row.GapYears*10) / 10,
+			DetectedAt:              row.DetectedAt.Format(time.RFC3339),
+		})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Choropleth of the filtered taxa per country, the filters are the same as for the table
+func mapPage(c echo.Context) error {
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
+	metric, err := maps.ParseMetric(c.QueryParam("metric"))
+	if err != nil {
+		slog.Warn("Invalid map metric", "error", err)
+		metric = maps.MetricMedian
+	}
+	stats, err := q.GetCountryStats(internal.DB)
+	if err != nil {
+		slog.Error("Failed to get country stats", "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get map")
+	}
+	var svg strings.Builder
+	if err = maps.SVG(&svg, stats, metric, q.DescribeFilters()); err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to render map")
+	}
+
+	params := c.QueryParams()
+	params.Del("metric")
+	return render(c,
+		http.StatusAccepted,
+		components.PageMap(svg.String(), stats, metric, params.Encode(), q.DescribeFilters(), cacheBuster))
+}
+
+// Standalone SVG of the map for reports
+func mapSVG(c echo.Context) error {
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
+	metric, err := maps.ParseMetric(c.QueryParam("metric"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	stats, err := q.GetCountryStats(internal.DB)
+	if err != nil {
+		slog.Error("Failed to get country stats", "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get map")
+	}
+	var svg strings.Builder
+	if err = maps.SVG(&svg, stats, metric, q.DescribeFilters()); err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to render map")
+	}
+	return c.Blob(http.StatusOK, "image/svg+xml", []byte(svg.String()))
+}
+
+// Country shapes with the number of taxa and the median and maximum years since the latest observation as properties
+func mapGeoJSON(c echo.Context) error {
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
+	stats, err := q.GetCountryStats(internal.DB)
+	if err != nil {
+		slog.Error("Failed to get country stats", "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get map")
+	}
+	body, err := maps.GeoJSON(stats)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to render map")
+	}
+	return c.Blob(http.StatusOK, "application/geo+json", body)
 }
 
 /* Partials */
+// Progress of the backbone refresh with the latest fetch runs and failures
+func admin(c echo.Context) error {
+	return render(c,
+		http.StatusAccepted,
+		components.PageAdmin(
+			queries.GetRefreshProgress(internal.DB, gbif.RefreshStaleMonths),
+			queries.GetFetchErrorCounts(internal.DB, 7),
+			queries.GetFetchRuns(internal.DB, 1),
+			queries.GetFetchAttempts(internal.DB, "", true),
+			cacheBuster))
+}
+
+func adminRun(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return c.String(http.StatusBadRequest, "Run id must be numeric")
+	}
+	run, err := queries.GetFetchRun(internal.DB, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "Fetch run not found")
+	}
+	if err != nil {
+		slog.Error("Failed to get fetch run", "runID", id, "error", err)
+		return c.String(http.StatusInternalServerError, "Failed to get fetch run")
+	}
+
+	return render(c,
+		http.StatusAccepted,
+		components.PageAdminRun(run, queries.GetFetchAttempts(internal.DB, id, false), cacheBuster))
+}
+
 func table(c echo.Context) error {
-	q := buildQuery(c)
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
 	querystring := c.QueryString()
 
 	table := q.GetTableData(internal.DB)
@@ -141,6 +411,7 @@ func table(c echo.Context) error {
 }
 
 /* Actions */
+// Start a background fetch of the taxon, htmx gets an element which follows the progress of the job
 func fetch(c echo.Context) error {
 
 	id := c.QueryParam("taxonID")
@@ -151,48 +422,208 @@ func fetch(c echo.Context) error {
 	var err error
 	var synonymId string
 
-	synonymId, err = gbif.GetSynonymID(internal.DB, id)
+	ctx := c.Request().Context()
+	synonymId, err = gbif.GetSynonymID(ctx, internal.DB, id)
 	if err != nil {
 		c.Response().Header().Set("HX-Trigger", `{"showMessage":{"level" : "error", "message" : "Failed to get SynonymID"}}`)
 		return c.String(http.StatusBadRequest, "Failed to get SynonymID")
 	}
 
-	updated := gbif.UpdateLastFetchStatus(internal.DB, synonymId)
-	if !updated {
-		c.Response().Header().Set("HX-Trigger", `{"showMessage":{"level" : "error", "message" : "Failed to update the taxa, the ID could be missing in our database."}}`)
-		return c.String(http.StatusBadRequest, "Failed to update taxa")
+	job, err := fetchJobs.Start(ctx, synonymId)
+	if errors.Is(err, gbif.ErrFetchCooldown) {
+		return fetchLimited(c, fmt.Sprintf("This taxon was fetched less than %d minutes ago, please try again later.", int(gbif.FetchCooldown.Minutes())))
+	}
+	if errors.Is(err, gbif.ErrTooManyFetches) {
+		return fetchLimited(c, "Too many fetches are running right now, please try again in a few minutes.")
+	}
+	if err != nil {
+		slog.Error("Failed to start fetch", "taxonID", synonymId, "error", err)
+		c.Response().Header().Set("HX-Trigger", `{"showMessage":{"level" : "error", "message" : "Failed to start the fetch."}}`)
+		return c.String(http.StatusInternalServerError, "Failed to start fetch")
+	}
+	if c.Request().Header.Get("HX-Request") == "" {
+		return c.JSON(http.StatusAccepted, newFetchJobStatus(job))
+	}
+	return render(c, http.StatusAccepted, components.FetchJob(job))
+}
+
+// Per IP limit of new manual fetches, each one fires dozens of GBIF requests under our user agent.
+// The IP is taken from echo's IPExtractor, see newIPExtractor.
+func fetchRateLimiter(perMin float64) echo.MiddlewareFunc {
+	if perMin <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(perMin / 60),
+			Burst:     max(1, int(perMin)),
+			ExpiresIn: 3 * time.Minute,
+		}),
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			slog.Warn("Fetch rate limited", "ip", identifier)
+			return fetchLimited(c, "You started too many fetches, please wait a minute.")
+		},
+	})
+}
+
+// Client IP of a request, the X-Forwarded-For header is only used if the request comes from one of the trusted proxy ranges.
+// Without trusted proxies the IP of the connection is used, otherwise clients could fake their IP and skip the fetch limit.
+func newIPExtractor(trustedProxies string) (echo.IPExtractor, error) {
+	if strings.TrimSpace(trustedProxies) == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(trustedProxies, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// Helper to refuse a fetch with 429 and show the reason in the UI
+func fetchLimited(c echo.Context, message string) error {
+	c.Response().Header().Set("HX-Trigger", `{"showMessage":{"level" : "error", "message" : "`+message+`"}}`)
+	return c.String(http.StatusTooManyRequests, message)
+}
+
+// Fetch job with the message shown to the user if it failed
+type fetchJobStatus struct {
+	gbif.FetchJob
+	Message string `json:"message,omitempty"`
+}
+
+func newFetchJobStatus(job gbif.FetchJob) fetchJobStatus {
+	status := fetchJobStatus{FetchJob: job}
+	switch job.ErrorType {
+	case "":
+	case gbif.ErrorTypeNotFound:
+		status.Message = "No observations with a valid date found on GBIF for this taxon."
+	case gbif.ErrorTypeRateLimited:
+		status.Message = "GBIF is rate limiting our requests, please try again later."
+	case gbif.ErrorTypeSave:
+		status.Message = "Fetched data from GBIF but failed to save it, the old observations are kept."
+	case gbif.ErrorTypeCanceled:
+		status.Message = "Fetching from GBIF was canceled or took too long."
+	default:
+		status.Message = "GBIF is not reachable or timed out, please try again later."
+	}
+	return status
+}
+
+func fetchStatus(c echo.Context) error {
+	job, _, ok := fetchJobs.Get(c.Param("id"))
+	if !ok {
+		return c.String(http.StatusNotFound, "Fetch job not found")
 	}
+	return c.JSON(http.StatusOK, newFetchJobStatus(job))
+}
 
-	res := gbif.FetchLatest(synonymId)
-	if res == nil {
-		c.Response().Header().Set("HX-Trigger", `{"showMessage":{"level" : "error", "message" : "Timeout or no data found on GBIF for this taxon."}}`)
-		return c.String(http.StatusNotFound, "No data found")
+// Server-sent events with the job status, a progress event on every change and a done event once the job finished
+func fetchEvents(c echo.Context) error {
+	id := c.Param("id")
+	job, changed, ok := fetchJobs.Get(id)
+	if !ok {
+		return c.String(http.StatusNotFound, "Fetch job not found")
 	}
 
-	var results = &[][]gbif.LatestObservation{}
-	*results = append(*results, *res)
-	gbif.SaveObservation(results, internal.DB)
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	ctx := c.Request().Context()
+	for {
+		event := "progress"
+		if job.Finished() {
+			event = "done"
+		}
+		data, err := json.Marshal(newFetchJobStatus(job))
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			slog.Debug("Fetch events client gone", "jobID", id, "error", err)
+			return nil
+		}
+		w.Flush()
+		if job.Finished() {
+			return nil
+		}
 
-	c.Response().Header().Set("HX-Trigger", "filterSubmit")
-	return c.String(http.StatusOK, "Updated")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+		if job, changed, ok = fetchJobs.Get(id); !ok {
+			return nil
+		}
+	}
 }
 
-// Download data as CSV
+// Download all rows matching the filters as CSV, TSV, NDJSON, Excel or Parquet with optional column selection
 func download(c echo.Context) error {
+	q, err := buildQuery(c)
+	if err != nil {
+		return invalidQuery(c, err)
+	}
+	columns, err := queries.ParseExportColumns(c.QueryParam("columns"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	format, contentType, err := queries.ParseExportFormat(c.QueryParam("format"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	filename := fmt.Sprintf("extinct-%s-%s.%s", time.Now().Format("2006-01-02"), strings.ReplaceAll(c.QueryString(), "&", "-"), format)
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().Header().Set("Content-Type", contentType)
 
-	q := buildQuery(c)
-	table := q.GetTableData(internal.DB, true)
-	csv := table.CreateCSV()
+	count, err := q.Export(c.Request().Context(), internal.DB, c.Response(), columns, format)
+	if err != nil {
+		slog.Error("Failed to export download", "format", format, "rows", count, "error", err)
+		if !c.Response().Committed {
+			c.Response().Header().Del("Content-Disposition")
+			c.Response().Header().Del("Content-Type")
+			return c.String(http.StatusInternalServerError, "Failed to export data")
+		}
+		// The status is already sent, the client sees a truncated file
+		return nil
+	}
+	slog.Info("Download finished", "format", format, "rows", count)
+	return nil
+}
 
-	filename := fmt.Sprintf("extinct-%s-%s.csv", time.Now().Format("2006-01-02"), strings.ReplaceAll(c.QueryString(), "&", "-"))
+/* Operations */
+// The process is up and serving requests
+func healthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
 
-	c.Response().Header().Set("Content-Disposition", "attachment; filename="+filename)
-	c.Response().Header().Set("Content-Type", "text/csv")
-	return c.String(http.StatusOK, csv)
+// The database is reachable and all migrations are applied
+func readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 5*time.Second)
+	defer cancel()
+	if err := internal.DB.PingContext(ctx); err != nil {
+		slog.Warn("Database not reachable", "error", err)
+		return c.String(http.StatusServiceUnavailable, "database not reachable")
+	}
+	pending, err := internal.PendingMigrations(ctx, internal.DB, internal.Files(migrations.FS, "migrations"))
+	if err != nil {
+		slog.Warn("Failed to get migration status", "error", err)
+		return c.String(http.StatusServiceUnavailable, "failed to get migration status")
+	}
+	if len(pending) > 0 {
+		return c.String(http.StatusServiceUnavailable, fmt.Sprintf("%d migrations pending", len(pending)))
+	}
+	return c.String(http.StatusOK, "ready")
 }
 
-// Setup cron scheduler
-func setupScheduler() {
+// Setup cron scheduler, the context is passed to each run so shutdown stops the running job
+func setupScheduler(ctx context.Context) {
 	interval := internal.Config.CronJobIntervalSec
 	if interval == 0 {
 		slog.Info("Scheduler disabled", "interval", interval)
@@ -201,50 +632,54 @@ func setupScheduler() {
 	slog.Info("Init Scheduler")
 
 	var err error
-	scheduler, err = gocron.NewScheduler()
+	scheduler, err = gocron.NewScheduler(
+		gocron.WithGlobalJobOptions(gocron.WithEventListeners(
+			gocron.AfterJobRunsWithError(func(jobID uuid.UUID, jobName string, err error) {
+				slog.Error("Cron finished with failures", "job", jobID, "error", err)
+			}),
+		)),
+	)
 	if err != nil {
 		slog.Error(err.Error())
 	}
 
 	j, err := scheduler.NewJob(
 		gocron.DurationJob(time.Duration(interval)*time.Second),
-		gocron.NewTask(cronFetch),
+		gocron.NewTask(cronFetch, ctx),
 		gocron.WithSingletonMode(gocron.LimitModeReschedule),
 	)
 	if err != nil {
-		slog.Error("Failed to create job", err)
+		slog.Error("Failed to create job", "error", err)
 	}
 	slog.Info("Job created", "job", j.ID())
 }
 
-// Fetch outdated observations and update according to latest data
-func cronFetch() {
+// Fetch outdated observations and update according to latest data.
+// Returns the joined errors of the failed taxa, which are reported by the scheduler event listener.
+func cronFetch(ctx context.Context) error {
 	slog.Info("Starting cron")
 
-	ids := gbif.GetOutdatedObservations(internal.DB)
-	var results = &[][]gbif.LatestObservation{}
-	for _, id := range ids {
-		gbif.UpdateLastFetchStatus(internal.DB, id)
-		res := gbif.FetchLatest(id)
-		if res == nil {
-			continue
-		}
-		*results = append(*results, *res)
+	result, err := gbifClient.DrainRefreshQueue(ctx, internal.DB, gbif.TriggerCron)
+	outcome := metrics.CronSuccess
+	if len(result.Failed) > 0 {
+		outcome = metrics.CronPartial
 	}
-
-	if len(*results) == 0 {
-		slog.Info("No new observations found")
-		return
+	if err != nil {
+		slog.Warn("Cron stopped early", "error", err)
+		outcome = metrics.CronStopped
 	}
-
-	gbif.SaveObservation(results, internal.DB)
+	metrics.CronBatches.WithLabelValues(outcome).Inc()
+	metrics.CronTaxa.WithLabelValues("updated").Add(float64(result.Updated))
+	metrics.CronTaxa.WithLabelValues("not_found").Add(float64(result.NotFound))
+	metrics.CronTaxa.WithLabelValues("failed").Add(float64(len(result.Failed)))
+	return result.Err()
 }
 
 // Utility function to render a template
 func render(c echo.Context, status int, t templ.Component) error {
 	ctx, cancel := context.WithTimeout(c.Request().Context(), 25*time.Second)
 	defer cancel()
-	c.Response().Writer.WriteHeader(status)
+	c.Response().WriteHeader(status)
 	err := t.Render(ctx, c.Response().Writer)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "failed to render response template")
@@ -252,13 +687,22 @@ func render(c echo.Context, status int, t templ.Component) error {
 	return nil
 }
 
-// Utility function to build a query struct with sane and clean defaults from the payload parser
-func buildQuery(c echo.Context) queries.Query {
+// Utility function to build a query struct with sane and clean defaults from the payload parser.
+// Filters which cannot be applied are returned as error, use invalidQuery to answer them.
+func buildQuery(c echo.Context) (queries.Query, error) {
 	var payload Payload
 	err := c.Bind(&payload)
 	if err != nil {
 		slog.Warn("Failed to bind payload", "error", err)
-		return queries.NewQuery(nil)
+		return queries.NewQuery(nil), nil
 	}
-	return queries.NewQuery(payload)
+	q := queries.NewQuery(payload)
+	return q, q.Validate()
+}
+
+// Helper to refuse a query with invalid filters with 400 and show the reason in the UI
+func invalidQuery(c echo.Context, err error) error {
+	trigger, _ := json.Marshal(map[string]any{"showMessage": map[string]string{"level": "error", "message": err.Error()}})
+	c.Response().Header().Set("HX-Trigger", string(trigger))
+	return c.String(http.StatusBadRequest, err.Error())
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFetchRateLimiter(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		remoteAddr     string
+		want           []int
+	}{
+		{"forwarded for ignored without trusted proxies", "", "203.0.113.7:4711", []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}},
+		{"forwarded for ignored from untrusted peer", "10.0.0.0/8", "203.0.113.7:4711", []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}},
+		{"forwarded for used from trusted proxy", "10.0.0.0/8", "10.0.0.2:4711", []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			var err error
+			e.IPExtractor, err = newIPExtractor(tt.trustedProxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.GET("/fetch", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}, fetchRateLimiter(2))
+
+			/* Each request claims another client IP */
+			for i, want := range tt.want {
+				req := httptest.NewRequest(http.MethodGet, "/fetch", nil)
+				req.RemoteAddr = tt.remoteAddr
+				req.Header.Set(echo.HeaderXForwardedFor, []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"}[i])
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("request %d: got %d, wanted %d", i+1, rec.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewIPExtractor(t *testing.T) {
+	if _, err := newIPExtractor("10.0.0.0/8, 192.168.1.0/24"); err != nil {
+		t.Errorf("got %v, wanted no error", err)
+	}
+	if _, err := newIPExtractor("10.0.0.0/8,proxy"); err == nil {
+		t.Error("got no error, wanted invalid CIDR error")
+	}
+}
+
+func TestCountry(t *testing.T) {
+	e := echo.New()
+	e.GET("/country/:code", country)
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"/country/QQ", http.StatusNotFound},
+		{"/country/at", http.StatusMovedPermanently},
+		{"/country/A1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if rec.Code != tt.want {
+			t.Errorf("got %d, wanted %d for %s", rec.Code, tt.want, tt.url)
+		}
+	}
+}